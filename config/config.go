@@ -0,0 +1,198 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Config holds the runtime settings of the API. Every setting has a default,
+// so the server runs without any configuration file.
+type Config struct {
+	Filters FiltersConfig `json:"filters"`
+	Fetch   FetchConfig   `json:"fetch"`
+	Results ResultsConfig `json:"result_cache"`
+	Jobs    JobsConfig    `json:"jobs"`
+}
+
+// FiltersConfig holds the settings of the filter endpoints.
+type FiltersConfig struct {
+	// GIFWorkers is the number of GIF frames filtered concurrently by a single
+	// request. Zero uses one worker per available CPU.
+	GIFWorkers int `json:"gif_workers"`
+	// MaxUploadSize is the largest image, in bytes, accepted in the body of a
+	// POST request to the filter endpoints.
+	MaxUploadSize int64 `json:"max_upload_size"`
+	// MaxWidth and MaxHeight are the largest dimensions, in pixels, of the images
+	// filtered. Zero disables the limit.
+	MaxWidth  int `json:"max_width"`
+	MaxHeight int `json:"max_height"`
+	// MaxMegapixels bounds the pixels decoded for an image, in millions, counting
+	// every frame of an animation. Zero disables the limit.
+	MaxMegapixels float64 `json:"max_megapixels"`
+	// MaxFrames is the largest number of frames of an animation. Zero disables the limit.
+	MaxFrames int `json:"max_frames"`
+	// Downscale scales images larger than MaxWidth or MaxHeight down to fit, instead
+	// of rejecting them.
+	Downscale bool `json:"downscale"`
+	// Timeout bounds the processing of a request, from loading the image to encoding
+	// the result. Zero disables it.
+	Timeout Duration `json:"timeout"`
+	// Capacity is the total weight of the images filtered at once, a still image
+	// weighing 1 and an animation 1 per frame. Zero uses 16 per available CPU.
+	Capacity int `json:"capacity"`
+	// QueueSize is the number of requests waiting for capacity; requests beyond it
+	// are refused with 503 Service Unavailable.
+	QueueSize int `json:"queue_size"`
+	// QueueTimeout is the longest a request waits for capacity before being refused.
+	QueueTimeout Duration `json:"queue_timeout"`
+	// MaxBatchItems bounds the images rendered by a batch request, the number of its
+	// images times the number of its pipelines. Zero disables the limit.
+	MaxBatchItems int `json:"max_batch_items"`
+}
+
+// FetchConfig holds the settings used to download images from the URLs given by clients.
+type FetchConfig struct {
+	// ConnectTimeout bounds establishing a connection to the image host.
+	ConnectTimeout Duration `json:"connect_timeout"`
+	// ReadTimeout bounds a whole download, redirects included.
+	ReadTimeout Duration `json:"read_timeout"`
+	// MaxSize is the largest image, in bytes, downloaded from a URL.
+	MaxSize int64 `json:"max_size"`
+	// MaxRedirects is the number of redirects followed for a single image.
+	MaxRedirects int `json:"max_redirects"`
+	// AllowPrivate lets image URLs point to loopback, private and link-local
+	// addresses. It must stay off on public deployments.
+	AllowPrivate bool `json:"allow_private"`
+	// UserAgent is the User-Agent header sent to image hosts. Empty uses the Go default.
+	UserAgent string `json:"user_agent"`
+	// AllowHosts, when not empty, lists the only hosts images may be downloaded from.
+	// Patterns such as "*.discordapp.net" match every subdomain of the given domain.
+	AllowHosts []string `json:"allow_hosts"`
+	// DenyHosts lists the hosts images are never downloaded from, with the same patterns.
+	DenyHosts []string `json:"deny_hosts"`
+	// Hosts holds per-host settings, keyed by host pattern.
+	Hosts map[string]HostConfig `json:"hosts"`
+	// CacheSize is the total size, in bytes, of the downloaded images kept to answer
+	// later requests for the same URL, as their caching headers allow. Zero disables it.
+	CacheSize int64 `json:"cache_size"`
+	// FileRoot enables file:// image URLs, limited to the files under this directory.
+	// Empty, the default, disables them.
+	FileRoot string `json:"file_root"`
+}
+
+// HostConfig holds the fetch settings of the hosts matching a pattern. Unset values
+// fall back to the FetchConfig ones.
+type HostConfig struct {
+	UserAgent string `json:"user_agent"`
+	MaxSize   int64  `json:"max_size"`
+}
+
+// ResultsConfig holds the settings of the cache of filtered images.
+type ResultsConfig struct {
+	// MemorySize is the total size, in bytes, of the filtered images kept in memory.
+	// Zero disables the memory tier.
+	MemorySize int64 `json:"memory_size"`
+	// DiskDir is the directory where filtered images are also kept, surviving restarts.
+	// Empty, the default, disables the disk tier.
+	DiskDir string `json:"disk_dir"`
+	// DiskSize is the total size, in bytes, of the filtered images kept on disk.
+	DiskSize int64 `json:"disk_size"`
+}
+
+// JobsConfig holds the settings of the asynchronous filter jobs.
+type JobsConfig struct {
+	// Workers is the number of jobs processed at once.
+	Workers int `json:"workers"`
+	// QueueSize is the number of jobs waiting for a worker; submissions beyond it are
+	// refused with 503 Service Unavailable.
+	QueueSize int `json:"queue_size"`
+	// Timeout bounds the processing of a job. Zero disables it.
+	Timeout Duration `json:"timeout"`
+	// TTL is how long a completed job and its result are kept.
+	TTL Duration `json:"ttl"`
+	// ResultsSize is the total size, in bytes, of the job results kept in memory. The
+	// jobs completed first are forgotten early when a new result needs the room.
+	ResultsSize int64 `json:"results_size"`
+}
+
+// Duration is a time.Duration read from JSON as a string such as "5s" or "1m30s".
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string with time.ParseDuration.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON formats the duration like time.Duration.String.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Default returns the configuration used when no configuration file is present.
+func Default() *Config {
+	return &Config{
+		Filters: FiltersConfig{
+			GIFWorkers:    0,
+			MaxUploadSize: 8 << 20,
+			MaxWidth:      8192,
+			MaxHeight:     8192,
+			MaxMegapixels: 64,
+			MaxFrames:     1000,
+			Timeout:       Duration(30 * time.Second),
+			QueueSize:     32,
+			QueueTimeout:  Duration(3 * time.Second),
+			MaxBatchItems: 50,
+		},
+		Fetch: FetchConfig{
+			ConnectTimeout: Duration(5 * time.Second),
+			ReadTimeout:    Duration(15 * time.Second),
+			MaxSize:        20 << 20,
+			MaxRedirects:   5,
+			CacheSize:      64 << 20,
+		},
+		Results: ResultsConfig{
+			MemorySize: 64 << 20,
+			DiskSize:   1 << 30,
+		},
+		Jobs: JobsConfig{
+			Workers:     2,
+			QueueSize:   16,
+			Timeout:     Duration(10 * time.Minute),
+			TTL:         Duration(30 * time.Minute),
+			ResultsSize: 256 << 20,
+		},
+	}
+}
+
+// Load reads the JSON configuration file at path on top of the defaults, so the file
+// only needs to contain the settings it changes. A missing file is not an error and
+// yields the default configuration.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -1,15 +1,24 @@
 package filters
 
 import (
+	"context"
 	"image"
-	"image/color"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"math/rand"
 
 	_ "github.com/chai2010/webp"
 )
 
+func init() {
+	Register(New("anime_outline", "Adds bold anime-style black outlines", []Param{
+		{Name: "threshold", Description: "Color difference above which a pixel becomes an outline", Integer: true, Default: 30, Min: 1, Max: 255},
+	}, func(ctx context.Context, img image.Image, args Args, _ *rand.Rand) (image.Image, error) {
+		return AnimeOutline(ctx, img, args.Int("threshold"))
+	}))
+}
+
 // AnimeOutline applies a simple edge detection filter to the given image.
 // It highlights the outlines by comparing the color differences between each pixel
 // and its right and bottom neighbors. If the combined color difference exceeds a
@@ -18,44 +27,97 @@ import (
 // suitable for creating an "anime-style" outline effect.
 //
 // Parameters:
-//   img image.Image - The source image to process.
+//   - img image.Image - The source image to process.
+//   - threshold int - The edge sensitivity; lower values draw more outlines (30 by default in the API).
 //
 // Returns:
-//   image.Image - A new image with detected outlines.
-func AnimeOutline(img image.Image) image.Image {
+//   - image.Image - A new image with detected outlines.
+func AnimeOutline(ctx context.Context, img image.Image, threshold int) (image.Image, error) {
 	bounds := img.Bounds()
-	dst := image.NewRGBA(bounds)
+	dst := NewRGBA(bounds)
+	limit := uint32(threshold * 3 * 256)
 
-	threshold := 30 // sensibilité des contours
-
-	for y := bounds.Min.Y + 1; y < bounds.Max.Y-1; y++ {
-		for x := bounds.Min.X + 1; x < bounds.Max.X-1; x++ {
-			c1 := img.At(x, y)
-			c2 := img.At(x+1, y)
-			c3 := img.At(x, y+1)
+	// The threshold is compared against 16-bit channel differences. Images other than
+	// RGBA are read at that precision, which their conversion to RGBA would round, and
+	// their kept pixels are the high bytes of those channels.
+	var src *image.RGBA
+	var wide *image.RGBA64
+	if rgba, ok := img.(*image.RGBA); ok {
+		src = rgba
+	} else {
+		wide = rgba64Of(img)
+	}
 
-			r1, g1, b1, _ := c1.RGBA()
-			r2, g2, b2, _ := c2.RGBA()
-			r3, g3, b3, _ := c3.RGBA()
+	err := parallelRows(ctx, bounds, func(y0, y1 int) {
+		// Each row is compared with the next one, which is read from the source image
+		// even when it lies in the following band. The first and last rows stay empty.
+		for y := max(y0, bounds.Min.Y+1); y < min(y1, bounds.Max.Y-1); y++ {
+			d := rowPix(dst, y)
+			if wide != nil {
+				s, below := rowPix64(wide, y), rowPix64(wide, y+1)
+				for x := bounds.Min.X + 1; x < bounds.Max.X-1; x++ {
+					i := 4 * (x - bounds.Min.X)
+					if wideDelta(s, below, 2*i) > limit {
+						copy(d[i:i+4], []uint8{0, 0, 0, 0xff})
+					} else {
+						d[i+0], d[i+1], d[i+2], d[i+3] = s[2*i+0], s[2*i+2], s[2*i+4], s[2*i+6]
+					}
+				}
+				continue
+			}
 
-			delta1 := absDiff(r1, r2) + absDiff(g1, g2) + absDiff(b1, b2)
-			delta2 := absDiff(r1, r3) + absDiff(g1, g3) + absDiff(b1, b3)
+			s, below := rowPix(src, y), rowPix(src, y+1)
+			for x := bounds.Min.X + 1; x < bounds.Max.X-1; x++ {
+				i := 4 * (x - bounds.Min.X)
+				right := i + 4
 
-			if delta1+delta2 > uint32(threshold*3*256) {
-				dst.Set(x, y, color.Black)
-			} else {
-				dst.Set(x, y, c1)
+				delta1 := absDiff(s[i+0], s[right+0]) + absDiff(s[i+1], s[right+1]) + absDiff(s[i+2], s[right+2])
+				delta2 := absDiff(s[i+0], below[i+0]) + absDiff(s[i+1], below[i+1]) + absDiff(s[i+2], below[i+2])
+				if (delta1+delta2)*0x101 > limit {
+					copy(d[i:i+4], []uint8{0, 0, 0, 0xff})
+				} else {
+					copy(d[i:i+4], s[i:i+4])
+				}
 			}
 		}
+	})
+	if err != nil {
+		ReleaseRGBA(dst)
+		return nil, err
+	}
+
+	return dst, nil
+}
+
+// wideDelta returns the sum of the 16-bit color differences between the pixel at index i
+// of the row s of an *image.RGBA64 and its right and bottom neighbours, the latter at the
+// same index of the row below.
+func wideDelta(s, below []uint8, i int) uint32 {
+	var delta uint32
+	for c := i; c < i+6; c += 2 {
+		v := channel16(s, c)
+		delta += absDiff16(v, channel16(s, c+8)) + absDiff16(v, channel16(below, c))
 	}
+	return delta
+}
 
-	return dst
+// channel16 returns the big-endian 16-bit channel value at index i of pix.
+func channel16(pix []uint8, i int) uint16 {
+	return uint16(pix[i])<<8 | uint16(pix[i+1])
+}
+
+// absDiff16 returns the absolute difference between two 16-bit channel values a and b.
+func absDiff16(a, b uint16) uint32 {
+	if a > b {
+		return uint32(a - b)
+	}
+	return uint32(b - a)
 }
 
-// absDiff returns the absolute difference between two uint32 values a and b.
-func absDiff(a, b uint32) uint32 {
+// absDiff returns the absolute difference between two channel values a and b.
+func absDiff(a, b uint8) uint32 {
 	if a > b {
-		return a - b
+		return uint32(a - b)
 	}
-	return b - a
+	return uint32(b - a)
 }
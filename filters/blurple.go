@@ -1,8 +1,8 @@
 package filters
 
 import (
+	"context"
 	"image"
-	"image/color"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
@@ -10,48 +10,59 @@ import (
 	_ "github.com/chai2010/webp"
 )
 
+func init() {
+	Register(New("blurple", "Applies a Discord blurple color overlay", nil, NoArgs(Blurple)))
+}
+
 // Blurple applies a "blurple" (blue-purple) themed filter to the given image.
 // The filter maps each pixel's luminance to a specific color in a blurple palette,
 // producing a stylized effect reminiscent of certain branding themes (e.g., Discord).
 // The output image preserves the original alpha channel.
 //
 // Parameters:
-//   img image.Image - The source image to be filtered.
+//   - img image.Image - The source image to be filtered.
 //
 // Returns:
-//   image.Image - A new image with the blurple filter applied.
-func Blurple(img image.Image) image.Image {
+//   - image.Image - A new image with the blurple filter applied.
+func Blurple(ctx context.Context, img image.Image) (image.Image, error) {
 	bounds := img.Bounds()
-	dst := image.NewRGBA(bounds)
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := img.At(x, y).RGBA()
-			r8 := float64(r >> 8)
-			g8 := float64(g >> 8)
-			b8 := float64(b >> 8)
-			a8 := uint8(a >> 8)
-
-			lum := (0.299*r8 + 0.587*g8 + 0.114*b8) / 255
-
-			var nr, ng, nb uint8
-
-			switch {
-			case lum >= 0.92:
-				nr, ng, nb = 255, 255, 255
-			case lum >= 0.7:
-				nr, ng, nb = 88, 101, 242
-			case lum >= 0.45:
-				nr, ng, nb = 69, 79, 191
-			case lum >= 0.15:
-				nr, ng, nb = 35, 39, 42
-			default:
-				nr, ng, nb = 35, 39, 42
-			}
+	src := rgbaOf(img)
+	dst := NewRGBA(bounds)
+
+	err := parallelRows(ctx, bounds, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			s, d := rowPix(src, y), rowPix(dst, y)
+			for i := 0; i < len(s); i += 4 {
+				r8 := float64(s[i+0])
+				g8 := float64(s[i+1])
+				b8 := float64(s[i+2])
+				a8 := s[i+3]
 
-			dst.Set(x, y, color.NRGBA{R: nr, G: ng, B: nb, A: a8})
+				lum := (0.299*r8 + 0.587*g8 + 0.114*b8) / 255
+
+				var nr, ng, nb uint8
+
+				switch {
+				case lum >= 0.92:
+					nr, ng, nb = 255, 255, 255
+				case lum >= 0.7:
+					nr, ng, nb = 88, 101, 242
+				case lum >= 0.45:
+					nr, ng, nb = 69, 79, 191
+				case lum >= 0.15:
+					nr, ng, nb = 35, 39, 42
+				default:
+					nr, ng, nb = 35, 39, 42
+				}
+
+				setNRGBA(d, i, nr, ng, nb, a8)
+			}
 		}
+	})
+	if err != nil {
+		ReleaseRGBA(dst)
+		return nil, err
 	}
 
-	return dst
+	return dst, nil
 }
@@ -1,8 +1,8 @@
 package filters
 
 import (
+	"context"
 	"image"
-	"image/color"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
@@ -11,35 +11,40 @@ import (
 	_ "github.com/chai2010/webp"
 )
 
+func init() {
+	Register(New("deepfry", "Chaotic contrast & saturation (meme style)", nil, NoArgs(Deepfry)))
+}
+
 // Deepfry applies a "deep-fry" effect to the given image by increasing saturation,
 // contrast, and shifting the color balance towards red-orange tones. This effect
 // is achieved by manipulating the RGB channels of each pixel, resulting in a
 // visually exaggerated and stylized image. The function returns a new image with
 // the applied effect, preserving the original image's dimensions.
-func Deepfry(img image.Image) image.Image {
+func Deepfry(ctx context.Context, img image.Image) (image.Image, error) {
 	bounds := img.Bounds()
-	dst := image.NewRGBA(bounds)
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := img.At(x, y).RGBA()
-
-			r8 := float64(r >> 8)
-			g8 := float64(g >> 8)
-			b8 := float64(b >> 8)
-
-			r8 = math.Min(255, r8*1.8+50)
-			g8 = math.Min(255, g8*1.4)
-			b8 = math.Min(255, b8*0.8)
-
-			dst.Set(x, y, color.NRGBA{
-				R: uint8(r8),
-				G: uint8(g8),
-				B: uint8(b8),
-				A: uint8(a >> 8),
-			})
+	src := rgbaOf(img)
+	dst := NewRGBA(bounds)
+
+	err := parallelRows(ctx, bounds, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			s, d := rowPix(src, y), rowPix(dst, y)
+			for i := 0; i < len(s); i += 4 {
+				r8 := float64(s[i+0])
+				g8 := float64(s[i+1])
+				b8 := float64(s[i+2])
+
+				r8 = math.Min(255, r8*1.8+50)
+				g8 = math.Min(255, g8*1.4)
+				b8 = math.Min(255, b8*0.8)
+
+				setNRGBA(d, i, uint8(r8), uint8(g8), uint8(b8), s[i+3])
+			}
 		}
+	})
+	if err != nil {
+		ReleaseRGBA(dst)
+		return nil, err
 	}
 
-	return dst
+	return dst, nil
 }
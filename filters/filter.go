@@ -0,0 +1,192 @@
+package filters
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Filter describes an image filter that can be looked up by name and applied to an image.
+// Every filter in this package registers itself into the package registry from an init
+// function, so adding a filter only requires adding a new file.
+type Filter interface {
+	// Name returns the unique name used to select the filter in the API.
+	Name() string
+	// Description returns a short human-readable summary of the effect.
+	Description() string
+	// Params returns the schema of the parameters accepted by the filter.
+	Params() []Param
+	// Random reports whether the filter output depends on randomness, meaning
+	// the same input may give a different result on every call.
+	Random() bool
+	// Apply runs the filter on img with the given parameter values and returns the
+	// resulting image. Args are expected to have been validated with ParseArgs.
+	// Random filters must draw every random number from rng, so the same seed
+	// always gives the same output; other filters ignore it.
+	// The result must be a new image that does not share pixels with img, since
+	// a Pipeline recycles intermediate images once the next step is done with them.
+	// Filters check ctx as they go, before each band of rows, and once it is done they
+	// stop and return a nil image and ctx.Err(), so an abandoned request stops using CPU.
+	Apply(ctx context.Context, img image.Image, args Args, rng *rand.Rand) (image.Image, error)
+}
+
+// ApplyFunc is the signature of the function backing a Filter created with New. It follows
+// the contract of Filter.Apply, ctx included, as do the filter functions of the package,
+// such as Negative, which take the context and report its error the same way.
+type ApplyFunc func(ctx context.Context, img image.Image, args Args, rng *rand.Rand) (image.Image, error)
+
+// NoArgs adapts a deterministic filter function that takes no parameters to an ApplyFunc.
+func NoArgs(fn func(context.Context, image.Image) (image.Image, error)) ApplyFunc {
+	return func(ctx context.Context, img image.Image, _ Args, _ *rand.Rand) (image.Image, error) {
+		return fn(ctx, img)
+	}
+}
+
+// Param describes a single numeric parameter accepted by a filter.
+type Param struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Integer     bool    `json:"integer"`
+	Default     float64 `json:"default"`
+	Min         float64 `json:"min"`
+	Max         float64 `json:"max"`
+}
+
+// simpleFilter is the Filter implementation returned by New.
+type simpleFilter struct {
+	name        string
+	description string
+	params      []Param
+	random      bool
+	apply       ApplyFunc
+}
+
+func (f *simpleFilter) Name() string        { return f.name }
+func (f *simpleFilter) Description() string { return f.description }
+func (f *simpleFilter) Params() []Param     { return f.params }
+func (f *simpleFilter) Random() bool        { return f.random }
+
+func (f *simpleFilter) Apply(ctx context.Context, img image.Image, args Args, rng *rand.Rand) (image.Image, error) {
+	return f.apply(ctx, img, args, rng)
+}
+
+// New creates a Filter from its name, description, parameter schema and apply function.
+func New(name, description string, params []Param, apply ApplyFunc) Filter {
+	return &simpleFilter{
+		name:        name,
+		description: description,
+		params:      params,
+		apply:       apply,
+	}
+}
+
+// NewRandom is like New but marks the filter as random, for filters whose output
+// is not fully determined by their input and parameters.
+func NewRandom(name, description string, params []Param, apply ApplyFunc) Filter {
+	return &simpleFilter{
+		name:        name,
+		description: description,
+		params:      params,
+		random:      true,
+		apply:       apply,
+	}
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Filter)
+)
+
+// Register adds f to the filter registry. It panics if a filter with the same
+// name has already been registered, since that can only be a programming error.
+func Register(f Filter) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	name := f.Name()
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("filters: filter %q registered twice", name))
+	}
+	registry[name] = f
+}
+
+// Lookup returns the registered filter with the given name.
+// The boolean is false if no such filter exists.
+func Lookup(name string) (Filter, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	f, ok := registry[name]
+	return f, ok
+}
+
+// All returns every registered filter sorted by name.
+func All() []Filter {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	all := make([]Filter, 0, len(registry))
+	for _, f := range registry {
+		all = append(all, f)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name() < all[j].Name() })
+	return all
+}
+
+// Suggest returns up to three registered filter names that closely match name,
+// ordered from the closest match. It is used to help clients recover from typos.
+func Suggest(name string) []string {
+	name = strings.ToLower(name)
+	maxDistance := len(name) / 3
+	if maxDistance < 2 {
+		maxDistance = 2
+	}
+
+	type candidate struct {
+		name     string
+		distance int
+	}
+	var candidates []candidate
+
+	for _, f := range All() {
+		d := levenshtein(name, f.Name())
+		if d <= maxDistance || (len(name) >= 3 && strings.Contains(f.Name(), name)) {
+			candidates = append(candidates, candidate{f.Name(), d})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+
+	suggestions := make([]string, 0, 3)
+	for i := 0; i < len(candidates) && i < 3; i++ {
+		suggestions = append(suggestions, candidates[i].name)
+	}
+	return suggestions
+}
+
+// levenshtein returns the edit distance between the strings a and b.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(b)]
+}
@@ -0,0 +1,268 @@
+package filters
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/golden.txt from the current filters")
+
+// goldenPath holds the digest of the output of every filter on every test input. It was
+// written by the filters as they were before they worked on Pix slices directly, so the
+// test locks in their behaviour: a change in the output of a filter must be deliberate,
+// and recorded by running the tests with -update.
+const goldenPath = "testdata/golden.txt"
+
+// testInput is an image the filters are tested on.
+type testInput struct {
+	name string
+	img  image.Image
+}
+
+// testInputs returns the images the filters are tested on: an opaque photo, a translucent
+// image with a non-zero origin, a sub-image sharing the pixels of a larger image, images a
+// single pixel wide and tall, and NRGBA and YCbCr images, which filters have to convert.
+func testInputs(tb testing.TB) []testInput {
+	tb.Helper()
+	photo := samplePhoto(tb)
+	rng := rand.New(rand.NewSource(3))
+
+	translucent := image.NewRGBA(image.Rect(7, 5, 7+131, 5+97))
+	fillRandom(translucent, rng)
+	column := image.NewRGBA(image.Rect(0, 0, 1, 37))
+	fillRandom(column, rng)
+	row := image.NewRGBA(image.Rect(0, 0, 37, 1))
+	fillRandom(row, rng)
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	fillRandom(nrgba, rng)
+	ycbcr := image.NewYCbCr(image.Rect(0, 0, 75, 49), image.YCbCrSubsampleRatio420)
+	rng.Read(ycbcr.Y)
+	rng.Read(ycbcr.Cb)
+	rng.Read(ycbcr.Cr)
+
+	return []testInput{
+		{"opaque", photo},
+		{"translucent", translucent},
+		{"subimage", photo.SubImage(image.Rect(33, 21, 300, 250))},
+		{"column", column},
+		{"row", row},
+		{"nrgba", nrgba},
+		{"ycbcr", ycbcr},
+	}
+}
+
+// samplePhoto returns the first frame of example/original.gif over an opaque white
+// background, as an RGBA image.
+func samplePhoto(tb testing.TB) *image.RGBA {
+	tb.Helper()
+	f, err := os.Open("../example/original.gif")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	frame, err := gif.Decode(f)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	photo := image.NewRGBA(frame.Bounds())
+	draw.Draw(photo, photo.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(photo, photo.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	return photo
+}
+
+// fillRandom sets every pixel of img to a random, possibly translucent, color.
+func fillRandom(img draw.Image, rng *rand.Rand) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			img.Set(x, y, color.NRGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256))})
+		}
+	}
+}
+
+// testParams lists the parameter sets each filter is tested with, besides its defaults.
+var testParams = map[string][]map[string]string{
+	"pixelate":      {{"block": "2"}, {"block": "13"}},
+	"posterize":     {{"levels": "3"}, {"levels": "64"}},
+	"anime_outline": {{"threshold": "1"}, {"threshold": "200"}},
+	"poppink":       {{"threshold": "0"}, {"threshold": "45.5"}},
+}
+
+// testCase is a filter with one of its parameter sets.
+type testCase struct {
+	filter Filter
+	raw    map[string]string
+	args   Args
+}
+
+// name returns the name of the case, as in the golden file: the filter name, then the
+// parameters or "default".
+func (tc testCase) name() string {
+	if len(tc.raw) == 0 {
+		return tc.filter.Name() + " default"
+	}
+	params := make([]string, 0, len(tc.raw))
+	for k, v := range tc.raw {
+		params = append(params, k+"="+v)
+	}
+	sort.Strings(params)
+	return tc.filter.Name() + " " + strings.Join(params, "&")
+}
+
+// testCases returns every registered filter with its default parameters and the sets
+// of testParams.
+func testCases(tb testing.TB) []testCase {
+	tb.Helper()
+	var cases []testCase
+	for _, f := range All() {
+		for _, raw := range append([]map[string]string{nil}, testParams[f.Name()]...) {
+			args, err := ParseArgs(f, raw)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			cases = append(cases, testCase{filter: f, raw: raw, args: args})
+		}
+	}
+	return cases
+}
+
+// applyTest applies tc to img, random filters drawing from a source with a fixed seed.
+func applyTest(tc testCase, img image.Image) (image.Image, error) {
+	return tc.filter.Apply(context.Background(), img, tc.args, rand.New(rand.NewSource(42)))
+}
+
+// digest returns the SHA-256 of the bounds and the premultiplied RGBA pixels of img.
+func digest(img image.Image) string {
+	b := img.Bounds()
+	rgba := image.NewRGBA(b)
+	draw.Draw(rgba, b, img, b.Min, draw.Src)
+
+	h := sha256.New()
+	fmt.Fprintln(h, b)
+	h.Write(rgba.Pix)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func readGolden(t *testing.T) map[string]string {
+	t.Helper()
+	f, err := os.Open(goldenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	golden := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.LastIndexByte(line, ' ')
+		golden[line[:i]] = line[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return golden
+}
+
+// TestGolden checks the output of every filter, with several parameter sets, on every
+// test input against the digests of goldenPath.
+func TestGolden(t *testing.T) {
+	var golden map[string]string
+	if !*update {
+		golden = readGolden(t)
+	}
+
+	var lines []string
+	for _, in := range testInputs(t) {
+		for _, tc := range testCases(t) {
+			key := in.name + " " + tc.name()
+			out, err := applyTest(tc, in.img)
+			if err != nil {
+				t.Fatalf("%s: %v", key, err)
+			}
+
+			got := digest(out)
+			lines = append(lines, key+" "+got)
+			if want, ok := golden[key]; !*update && !ok {
+				t.Errorf("%s: no golden digest, run the tests with -update", key)
+			} else if !*update && got != want {
+				t.Errorf("%s: output differs from the golden image", key)
+			}
+		}
+	}
+
+	if *update {
+		if err := os.WriteFile(goldenPath, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestApplyLeavesSourceUntouched checks that no filter writes to its input.
+func TestApplyLeavesSourceUntouched(t *testing.T) {
+	for _, in := range testInputs(t) {
+		before := digest(in.img)
+		for _, tc := range testCases(t) {
+			if _, err := applyTest(tc, in.img); err != nil {
+				t.Fatal(err)
+			}
+			if digest(in.img) != before {
+				t.Fatalf("%s %s: source image modified", in.name, tc.name())
+			}
+		}
+	}
+}
+
+// TestApplyStopsWhenCancelled checks the contract of Filter.Apply on a done context: every
+// filter gives up, returning a nil image and ctx.Err().
+func TestApplyStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	photo := samplePhoto(t)
+	for _, tc := range testCases(t) {
+		out, err := tc.filter.Apply(ctx, photo, tc.args, rand.New(rand.NewSource(42)))
+		if out != nil || !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: got image %v and error %v, want no image and context.Canceled", tc.name(), out != nil, err)
+		}
+	}
+}
+
+// BenchmarkFilter measures every filter, with its default parameters, on the sample photo.
+func BenchmarkFilter(b *testing.B) {
+	photo := samplePhoto(b)
+	for _, f := range All() {
+		args, err := ParseArgs(f, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(f.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(photo.Pix)))
+			rng := rand.New(rand.NewSource(42))
+			for b.Loop() {
+				out, err := f.Apply(context.Background(), photo, args, rng)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if rgba, ok := out.(*image.RGBA); ok {
+					ReleaseRGBA(rgba)
+				}
+			}
+		})
+	}
+}
@@ -1,8 +1,8 @@
 package filters
 
 import (
+	"context"
 	"image"
-	"image/color"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
@@ -11,61 +11,68 @@ import (
 	_ "github.com/chai2010/webp"
 )
 
+func init() {
+	Register(NewRandom("glitch", "RGB split + distortion effect", nil, func(ctx context.Context, img image.Image, _ Args, rng *rand.Rand) (image.Image, error) {
+		return Glitch(ctx, img, rng)
+	}))
+}
+
 // Glitch applies a "glitch" visual effect to the given image by randomly shifting the red, green, and blue channels
 // horizontally on each scanline, and by adding several random horizontal color bands. This creates a distorted,
 // glitch-art appearance. The function returns a new image with the effect applied.
+// Every random value is drawn from rng, so the same seed always produces the same image.
 //
 // Parameters:
-//   img image.Image - The source image to which the glitch effect will be applied.
+//   - img image.Image - The source image to which the glitch effect will be applied.
+//   - rng *rand.Rand - The random source driving the channel shifts and color bands.
 //
 // Returns:
-//   image.Image - A new image with the glitch effect applied.
-func Glitch(img image.Image) image.Image {
+//   - image.Image - A new image with the glitch effect applied.
+func Glitch(ctx context.Context, img image.Image, rng *rand.Rand) (image.Image, error) {
 	bounds := img.Bounds()
-	dst := image.NewRGBA(bounds)
+	src := rgbaOf(img)
+	dst := NewRGBA(bounds)
 
 	height := bounds.Dy()
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		offsetR := rand.Intn(6) - 3
-		offsetG := rand.Intn(6) - 3
-		offsetB := rand.Intn(6) - 3
+	// The per-row offsets are drawn up front, in row order, so the output does not
+	// depend on how the rows are split between goroutines.
+	offsets := make([][3]int, height)
+	for i := range offsets {
+		offsets[i] = [3]int{rng.Intn(6) - 3, rng.Intn(6) - 3, rng.Intn(6) - 3}
+	}
 
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			rx := clamp(x+offsetR, bounds.Min.X, bounds.Max.X-1)
-			gx := clamp(x+offsetG, bounds.Min.X, bounds.Max.X-1)
-			bx := clamp(x+offsetB, bounds.Min.X, bounds.Max.X-1)
+	err := parallelRows(ctx, bounds, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			offsetR, offsetG, offsetB := offsets[y-bounds.Min.Y][0], offsets[y-bounds.Min.Y][1], offsets[y-bounds.Min.Y][2]
 
-			r, _, _, _ := img.At(rx, y).RGBA()
-			_, g, _, _ := img.At(gx, y).RGBA()
-			_, _, b, a := img.At(bx, y).RGBA()
+			s, d := rowPix(src, y), rowPix(dst, y)
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				ri := 4 * (clamp(x+offsetR, bounds.Min.X, bounds.Max.X-1) - bounds.Min.X)
+				gi := 4 * (clamp(x+offsetG, bounds.Min.X, bounds.Max.X-1) - bounds.Min.X)
+				bi := 4 * (clamp(x+offsetB, bounds.Min.X, bounds.Max.X-1) - bounds.Min.X)
 
-			dst.Set(x, y, color.NRGBA{
-				R: uint8(r >> 8),
-				G: uint8(g >> 8),
-				B: uint8(b >> 8),
-				A: uint8(a >> 8),
-			})
+				setNRGBA(d, 4*(x-bounds.Min.X), s[ri+0], s[gi+1], s[bi+2], s[bi+3])
+			}
 		}
+	})
+	if err != nil {
+		ReleaseRGBA(dst)
+		return nil, err
 	}
 
 	for i := 0; i < 5; i++ {
-		yStart := rand.Intn(height)
-		bandHeight := rand.Intn(10) + 5
-		colorShift := uint8(rand.Intn(100))
+		yStart := rng.Intn(height)
+		bandHeight := rng.Intn(10) + 5
+		colorShift := uint8(rng.Intn(100))
 
-		for y := yStart; y < yStart+bandHeight && y < bounds.Max.Y; y++ {
-			for x := bounds.Min.X; x < bounds.Max.X; x++ {
-				r, g, b, a := dst.At(x, y).RGBA()
-				dst.Set(x, y, color.NRGBA{
-					R: uint8(r>>8) ^ colorShift,
-					G: uint8(g>>8) ^ colorShift,
-					B: uint8(b>>8) ^ colorShift,
-					A: uint8(a >> 8),
-				})
+		for y := max(yStart, bounds.Min.Y); y < yStart+bandHeight && y < bounds.Max.Y; y++ {
+			d := rowPix(dst, y)
+			for j := 0; j < len(d); j += 4 {
+				setNRGBA(d, j, d[j+0]^colorShift, d[j+1]^colorShift, d[j+2]^colorShift, d[j+3])
 			}
 		}
 	}
 
-	return dst
-}
\ No newline at end of file
+	return dst, nil
+}
@@ -1,8 +1,8 @@
 package filters
 
 import (
+	"context"
 	"image"
-	"image/color"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
@@ -10,29 +10,40 @@ import (
 	_ "github.com/chai2010/webp"
 )
 
+func init() {
+	Register(New("greyscale", "Converts image to grayscale", nil, NoArgs(Greyscale)))
+}
+
 // Greyscale converts the given image to greyscale using standard luminance calculation.
 // It iterates over each pixel, computes the luminance based on the RGB values, and sets
 // the resulting pixel to a shade of grey with the original alpha value preserved.
 //
 // Parameters:
-//   img image.Image - The source image to be converted to greyscale.
+//   - img image.Image - The source image to be converted to greyscale.
 //
 // Returns:
-//   image.Image - A new image in greyscale.
-func Greyscale(img image.Image) image.Image {
+//   - image.Image - A new image in greyscale.
+func Greyscale(ctx context.Context, img image.Image) (image.Image, error) {
 	bounds := img.Bounds()
-	dst := image.NewRGBA(bounds)
+	src := rgbaOf(img)
+	dst := NewRGBA(bounds)
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := img.At(x, y).RGBA()
-			a8 := uint8(a >> 8)
+	err := parallelRows(ctx, bounds, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			s, d := rowPix(src, y), rowPix(dst, y)
+			for i := 0; i < len(s); i += 4 {
+				a8 := s[i+3]
 
-			lum := uint8((0.299*float64(r>>8) + 0.587*float64(g>>8) + 0.114*float64(b>>8)))
+				lum := uint8((0.299*float64(s[i+0]) + 0.587*float64(s[i+1]) + 0.114*float64(s[i+2])))
 
-			dst.Set(x, y, color.NRGBA{R: lum, G: lum, B: lum, A: a8})
+				setNRGBA(d, i, lum, lum, lum, a8)
+			}
 		}
+	})
+	if err != nil {
+		ReleaseRGBA(dst)
+		return nil, err
 	}
 
-	return dst
-}
\ No newline at end of file
+	return dst, nil
+}
@@ -1,8 +1,8 @@
 package filters
 
 import (
+	"context"
 	"image"
-	"image/color"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
@@ -10,25 +10,36 @@ import (
 	_ "github.com/chai2010/webp"
 )
 
+func init() {
+	Register(New("negative", "Inverts all colors (negative image)", nil, NoArgs(Negative)))
+}
+
 // Negative returns a new image that is the negative (color-inverted) version of the input image.
 // Each pixel's red, green, and blue channels are inverted, while the alpha channel is preserved.
 // The function supports any image.Image input and outputs an *image.RGBA.
-func Negative(img image.Image) image.Image {
+func Negative(ctx context.Context, img image.Image) (image.Image, error) {
 	bounds := img.Bounds()
-	dst := image.NewRGBA(bounds)
+	src := rgbaOf(img)
+	dst := NewRGBA(bounds)
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := img.At(x, y).RGBA()
-			a8 := uint8(a >> 8)
+	err := parallelRows(ctx, bounds, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			s, d := rowPix(src, y), rowPix(dst, y)
+			for i := 0; i < len(s); i += 4 {
+				a8 := s[i+3]
 
-			newR := uint8(255 - (r >> 8))
-			newG := uint8(255 - (g >> 8))
-			newB := uint8(255 - (b >> 8))
+				newR := 255 - s[i+0]
+				newG := 255 - s[i+1]
+				newB := 255 - s[i+2]
 
-			dst.Set(x, y, color.NRGBA{R: newR, G: newG, B: newB, A: a8})
+				setNRGBA(d, i, newR, newG, newB, a8)
+			}
 		}
+	})
+	if err != nil {
+		ReleaseRGBA(dst)
+		return nil, err
 	}
 
-	return dst
-}
\ No newline at end of file
+	return dst, nil
+}
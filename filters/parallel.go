@@ -0,0 +1,83 @@
+package filters
+
+import (
+	"context"
+	"image"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// minBandRows is the smallest band worth handing to its own goroutine.
+const minBandRows = 16
+
+// checkRows is the number of rows filtered between two checks of the context. It keeps
+// a cancelled filter from running for long while making the checks negligible.
+const checkRows = 64
+
+// parallelRows splits the rows of bounds into horizontal bands and calls fn
+// concurrently for each band, as the half-open row range [y0, y1). It returns once
+// every band is done. Bands never overlap, so fn may write its rows of a shared
+// destination image without locking; neighbourhood filters that need rows outside
+// their band read them from the source image, which is never written.
+//
+// Bands are handed to fn in slices of a few rows, and ctx is checked before each one:
+// once it is done the remaining rows are skipped and parallelRows returns ctx.Err().
+func parallelRows(ctx context.Context, bounds image.Rectangle, fn func(y0, y1 int)) error {
+	return parallelBands(ctx, bounds, 1, fn)
+}
+
+// parallelBands is like parallelRows, but every band boundary falls on a multiple
+// of align rows from bounds.Min.Y, for filters working on blocks of rows.
+func parallelBands(ctx context.Context, bounds image.Rectangle, align int, fn func(y0, y1 int)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	height := bounds.Dy()
+	if height <= 0 {
+		return nil
+	}
+
+	// run calls fn on [y0, y1) one slice at a time, slices staying aligned.
+	var stopped atomic.Bool
+	step := (checkRows + align - 1) / align * align
+	run := func(y0, y1 int) {
+		for y := y0; y < y1; y += step {
+			if ctx.Err() != nil {
+				stopped.Store(true)
+				return
+			}
+			fn(y, min(y+step, y1))
+		}
+	}
+
+	bands := runtime.GOMAXPROCS(0)
+	if maxBands := height / max(minBandRows, align); bands > maxBands {
+		bands = maxBands
+	}
+	if bands <= 1 {
+		run(bounds.Min.Y, bounds.Max.Y)
+	} else {
+		blocks := (height + align - 1) / align
+		var wg sync.WaitGroup
+		for i := 0; i < bands; i++ {
+			y0 := bounds.Min.Y + blocks*i/bands*align
+			y1 := min(bounds.Min.Y+blocks*(i+1)/bands*align, bounds.Max.Y)
+			if y0 >= y1 {
+				continue
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				run(y0, y1)
+			}()
+		}
+		wg.Wait()
+	}
+
+	if stopped.Load() {
+		return ctx.Err()
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package filters
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// bandProcs are the GOMAXPROCS values the band splitting is tested with: every value
+// moves the band edges, which neighbourhood filters read across.
+var bandProcs = []int{1, 2, 3, 5, 8, 13}
+
+// TestBandsCoverEveryRowOnce checks that parallelBands hands out every row of the bounds
+// exactly once, in bands starting on a multiple of align rows.
+func TestBandsCoverEveryRowOnce(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+
+	for _, procs := range bandProcs {
+		runtime.GOMAXPROCS(procs)
+		for _, align := range []int{1, 2, 7, 64} {
+			for _, bounds := range []image.Rectangle{image.Rect(0, 0, 3, 375), image.Rect(-4, 9, 5, 109), image.Rect(0, 0, 1, 1)} {
+				var mu sync.Mutex
+				seen := make(map[int]int)
+				err := parallelBands(context.Background(), bounds, align, func(y0, y1 int) {
+					if (y0-bounds.Min.Y)%align != 0 {
+						t.Errorf("procs %d, align %d, %v: band starts at row %d", procs, align, bounds, y0)
+					}
+					mu.Lock()
+					for y := y0; y < y1; y++ {
+						seen[y]++
+					}
+					mu.Unlock()
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+					if seen[y] != 1 {
+						t.Errorf("procs %d, align %d, %v: row %d handled %d times", procs, align, bounds, y, seen[y])
+					}
+				}
+				if len(seen) != bounds.Dy() {
+					t.Errorf("procs %d, align %d, %v: %d rows handled, want %d", procs, align, bounds, len(seen), bounds.Dy())
+				}
+			}
+		}
+	}
+}
+
+// TestBandsGiveIdenticalOutput checks that every filter gives the same bytes whatever the
+// number of bands the image is split into, including the filters reading the rows around
+// each pixel, such as anime_outline and poppink, at band edges.
+func TestBandsGiveIdenticalOutput(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+
+	inputs := testInputs(t)
+	cases := testCases(t)
+	want := make(map[string]string)
+	for _, procs := range bandProcs {
+		runtime.GOMAXPROCS(procs)
+		for _, in := range inputs {
+			for _, tc := range cases {
+				key := in.name + " " + tc.name()
+				out, err := applyTest(tc, in.img)
+				if err != nil {
+					t.Fatalf("%s: %v", key, err)
+				}
+
+				got := digest(out)
+				if procs == bandProcs[0] {
+					want[key] = got
+				} else if got != want[key] {
+					t.Errorf("%s: output with GOMAXPROCS %d differs from a single band", key, procs)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkBands measures a per-pixel filter, the filters reading neighbouring rows and the
+// block-aligned pixelate on the sample photo, on a single band and on one band per CPU.
+func BenchmarkBands(b *testing.B) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	photo := samplePhoto(b)
+	procsList := []int{1}
+	if cpus := runtime.NumCPU(); cpus > 1 {
+		procsList = append(procsList, cpus)
+	}
+
+	for _, name := range []string{"negative", "anime_outline", "poppink", "pixelate"} {
+		f, _ := Lookup(name)
+		args, err := ParseArgs(f, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, procs := range procsList {
+			b.Run(fmt.Sprintf("%s/procs=%d", name, procs), func(b *testing.B) {
+				runtime.GOMAXPROCS(procs)
+				b.SetBytes(int64(len(photo.Pix)))
+				rng := rand.New(rand.NewSource(42))
+				for b.Loop() {
+					out, err := f.Apply(context.Background(), photo, args, rng)
+					if err != nil {
+						b.Fatal(err)
+					}
+					ReleaseRGBA(out.(*image.RGBA))
+				}
+			})
+		}
+	}
+}
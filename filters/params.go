@@ -0,0 +1,77 @@
+package filters
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Args holds the parameter values passed to a filter, keyed by parameter name.
+type Args map[string]float64
+
+// Int returns the value of the named parameter as an int.
+func (a Args) Int(name string) int {
+	return int(a[name])
+}
+
+// Float returns the value of the named parameter as a float64.
+func (a Args) Float(name string) float64 {
+	return a[name]
+}
+
+// ParamError reports a filter parameter whose value is malformed or out of range.
+type ParamError struct {
+	Filter string
+	Param  string
+	Value  string
+	Reason string
+}
+
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("invalid value %q for %s parameter '%s': %s", e.Value, e.Filter, e.Param, e.Reason)
+}
+
+// ParseArgs validates the raw string values against the parameter schema of f and
+// returns the typed Args, using the parameter defaults for missing values.
+// Values not declared by the filter are ignored, so raw can be the whole query string.
+// A *ParamError naming the offending parameter is returned for malformed or
+// out-of-range values.
+func ParseArgs(f Filter, raw map[string]string) (Args, error) {
+	args := make(Args, len(f.Params()))
+
+	for _, p := range f.Params() {
+		value, ok := raw[p.Name]
+		if !ok || value == "" {
+			args[p.Name] = p.Default
+			continue
+		}
+
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, &ParamError{Filter: f.Name(), Param: p.Name, Value: value, Reason: "must be a number"}
+		}
+		if p.Integer && v != math.Trunc(v) {
+			return nil, &ParamError{Filter: f.Name(), Param: p.Name, Value: value, Reason: "must be an integer"}
+		}
+		if v < p.Min || v > p.Max {
+			return nil, &ParamError{
+				Filter: f.Name(),
+				Param:  p.Name,
+				Value:  value,
+				Reason: fmt.Sprintf("must be between %s and %s", formatParam(p, p.Min), formatParam(p, p.Max)),
+			}
+		}
+
+		args[p.Name] = v
+	}
+
+	return args, nil
+}
+
+// formatParam formats v for error messages according to the type of p.
+func formatParam(p Param, v float64) string {
+	if p.Integer {
+		return strconv.Itoa(int(v))
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,156 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxPipelineSteps is the maximum number of steps accepted by ParsePipeline.
+const MaxPipelineSteps = 10
+
+// Step is a single filter invocation within a Pipeline.
+type Step struct {
+	Filter Filter
+	Args   Args
+}
+
+// Pipeline is an ordered list of filter steps, each one applied to the output of the previous one.
+type Pipeline []Step
+
+// Single returns a pipeline made of the single filter f with the given arguments.
+func Single(f Filter, args Args) Pipeline {
+	return Pipeline{{Filter: f, Args: args}}
+}
+
+// Apply runs every step of the pipeline in order on img and returns the final image.
+// The image stays in memory between steps, so it is decoded and encoded only once.
+// Random steps draw from rng one after the other, keeping the whole pipeline reproducible.
+// The images produced by intermediate steps are released with ReleaseRGBA as soon as the
+// following step is done; the input img is left untouched and still belongs to the caller.
+// Once ctx is done, the running step stops early and Apply returns ctx.Err().
+func (p Pipeline) Apply(ctx context.Context, img image.Image, rng *rand.Rand) (image.Image, error) {
+	current := img
+	for _, step := range p {
+		next, err := step.Filter.Apply(ctx, current, step.Args, rng)
+		if rgba, ok := current.(*image.RGBA); ok && current != img && current != next {
+			ReleaseRGBA(rgba)
+		}
+		if err != nil {
+			return nil, err
+		}
+		current = next
+	}
+	return current, nil
+}
+
+// Random reports whether any step of the pipeline uses a random filter.
+func (p Pipeline) Random() bool {
+	for _, step := range p {
+		if step.Filter.Random() {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the canonical specification of the pipeline, in the syntax of
+// ParsePipeline with every parameter spelled out in name order:
+//
+//	deepfry,pixelate:block=10,glitch
+//
+// Pipelines that apply the same filters with the same arguments have the same
+// specification, however they were written by the client.
+func (p Pipeline) String() string {
+	var b strings.Builder
+	for i, step := range p {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(step.Filter.Name())
+
+		names := make([]string, 0, len(step.Args))
+		for name := range step.Args {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&b, ":%s=%s", name, strconv.FormatFloat(step.Args[name], 'g', -1, 64))
+		}
+	}
+	return b.String()
+}
+
+// UnknownFilterError reports a filter name that is not in the registry,
+// along with the closest registered names.
+type UnknownFilterError struct {
+	Name        string
+	Suggestions []string
+}
+
+func (e *UnknownFilterError) Error() string {
+	return fmt.Sprintf("unknown filter '%s'", e.Name)
+}
+
+// ParsePipeline parses a pipeline specification made of comma-separated steps,
+// each step being a filter name optionally followed by colon-separated parameters:
+//
+//	deepfry,pixelate:block=10,glitch
+//	anime_outline:threshold=45,posterize:levels=3
+//
+// It returns an *UnknownFilterError for unknown filter names and a *ParamError
+// for unknown, malformed or out-of-range parameters.
+func ParsePipeline(spec string) (Pipeline, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, errors.New("pipeline has no steps")
+	}
+
+	parts := strings.Split(spec, ",")
+	if len(parts) > MaxPipelineSteps {
+		return nil, fmt.Errorf("pipeline has %d steps, the maximum is %d", len(parts), MaxPipelineSteps)
+	}
+
+	pipeline := make(Pipeline, 0, len(parts))
+	for _, part := range parts {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+
+		name := fields[0]
+		f, ok := Lookup(name)
+		if !ok {
+			return nil, &UnknownFilterError{Name: name, Suggestions: Suggest(name)}
+		}
+
+		raw := make(map[string]string, len(fields)-1)
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			if !hasParam(f, key) {
+				return nil, &ParamError{Filter: name, Param: key, Value: value, Reason: "unknown parameter"}
+			}
+			raw[key] = value
+		}
+
+		args, err := ParseArgs(f, raw)
+		if err != nil {
+			return nil, err
+		}
+
+		pipeline = append(pipeline, Step{Filter: f, Args: args})
+	}
+
+	return pipeline, nil
+}
+
+// hasParam reports whether f declares a parameter with the given name.
+func hasParam(f Filter, name string) bool {
+	for _, p := range f.Params() {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -1,58 +1,97 @@
 package filters
 
 import (
+	"context"
 	"image"
-	"image/color"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"math/rand"
 
 	_ "github.com/chai2010/webp"
 )
 
-// Pixelate applies a pixelation effect to the given image by dividing it into blocks of fixed size
+func init() {
+	Register(New("pixelate", "Low-resolution pixel art effect", []Param{
+		{Name: "block", Description: "Size in pixels of each square block", Integer: true, Default: 6, Min: 2, Max: 128},
+	}, func(ctx context.Context, img image.Image, args Args, _ *rand.Rand) (image.Image, error) {
+		return Pixelate(ctx, img, args.Int("block"))
+	}))
+}
+
+// Pixelate applies a pixelation effect to the given image by dividing it into square blocks
 // and replacing each block with its average color. The function returns a new image with the effect applied.
 //
 // Parameters:
 //   - img: The source image to be pixelated.
+//   - blockSize: The size in pixels of each block (6 by default in the API).
 //
 // Returns:
 //   - image.Image: A new image with the pixelation effect applied.
-func Pixelate(img image.Image) image.Image {
+func Pixelate(ctx context.Context, img image.Image, blockSize int) (image.Image, error) {
 	bounds := img.Bounds()
-	dst := image.NewRGBA(bounds)
-	blockSize := 6
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y += blockSize {
-		for x := bounds.Min.X; x < bounds.Max.X; x += blockSize {
-			var rTotal, gTotal, bTotal, aTotal uint32
-			var count uint32
-
-			for yy := y; yy < y+blockSize && yy < bounds.Max.Y; yy++ {
-				for xx := x; xx < x+blockSize && xx < bounds.Max.X; xx++ {
-					r, g, b, a := img.At(xx, yy).RGBA()
-					rTotal += r
-					gTotal += g
-					bTotal += b
-					aTotal += a
-					count++
+	dst := NewRGBA(bounds)
+
+	// Blocks are averaged on 16-bit channels. Images other than RGBA are read at that
+	// precision, which their conversion to RGBA would round.
+	var src *image.RGBA
+	var wide *image.RGBA64
+	if rgba, ok := img.(*image.RGBA); ok {
+		src = rgba
+	} else {
+		wide = rgba64Of(img)
+	}
+
+	// Bands are aligned on whole blocks so no block is shared between two bands.
+	err := parallelBands(ctx, bounds, blockSize, func(y0, y1 int) {
+		for y := y0; y < y1; y += blockSize {
+			for x := bounds.Min.X; x < bounds.Max.X; x += blockSize {
+				var rTotal, gTotal, bTotal, aTotal uint32
+				var count uint32
+
+				x1 := min(x+blockSize, bounds.Max.X)
+				i0, i1 := 4*(x-bounds.Min.X), 4*(x1-bounds.Min.X)
+
+				for yy := y; yy < y+blockSize && yy < bounds.Max.Y; yy++ {
+					count += uint32(x1 - x)
+					if wide != nil {
+						for xx := x; xx < x1; xx++ {
+							c := wide.RGBA64At(xx, yy)
+							rTotal += uint32(c.R)
+							gTotal += uint32(c.G)
+							bTotal += uint32(c.B)
+							aTotal += uint32(c.A)
+						}
+						continue
+					}
+
+					s := rowPix(src, yy)
+					for i := i0; i < i1; i += 4 {
+						rTotal += uint32(s[i+0]) * 0x101
+						gTotal += uint32(s[i+1]) * 0x101
+						bTotal += uint32(s[i+2]) * 0x101
+						aTotal += uint32(s[i+3]) * 0x101
+					}
 				}
-			}
 
-			avgColor := color.NRGBA{
-				R: uint8((rTotal / count) >> 8),
-				G: uint8((gTotal / count) >> 8),
-				B: uint8((bTotal / count) >> 8),
-				A: uint8((aTotal / count) >> 8),
-			}
+				avgR := uint8((rTotal / count) >> 8)
+				avgG := uint8((gTotal / count) >> 8)
+				avgB := uint8((bTotal / count) >> 8)
+				avgA := uint8((aTotal / count) >> 8)
 
-			for yy := y; yy < y+blockSize && yy < bounds.Max.Y; yy++ {
-				for xx := x; xx < x+blockSize && xx < bounds.Max.X; xx++ {
-					dst.Set(xx, yy, avgColor)
+				for yy := y; yy < y+blockSize && yy < bounds.Max.Y; yy++ {
+					d := rowPix(dst, yy)
+					for i := i0; i < i1; i += 4 {
+						setNRGBA(d, i, avgR, avgG, avgB, avgA)
+					}
 				}
 			}
 		}
+	})
+	if err != nil {
+		ReleaseRGBA(dst)
+		return nil, err
 	}
 
-	return dst
+	return dst, nil
 }
@@ -0,0 +1,61 @@
+package filters
+
+import (
+	"image"
+	"image/draw"
+)
+
+// rgbaOf returns img as an *image.RGBA so filters can work on its Pix slice directly.
+// Images that are already RGBA are returned as is; others are converted, which gives
+// the same premultiplied 8-bit values as img.At(x, y).RGBA() shifted right by 8.
+func rgbaOf(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(bounds)
+	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// rgba64Of returns img converted to an *image.RGBA64, which holds the 16-bit premultiplied
+// values of img.At(x, y).RGBA() exactly. Filters whose arithmetic uses more than 8 bits per
+// channel read images other than RGBA through it, since rgbaOf rounds their channels.
+func rgba64Of(img image.Image) *image.RGBA64 {
+	bounds := img.Bounds()
+	wide := image.NewRGBA64(bounds)
+	draw.Draw(wide, bounds, img, bounds.Min, draw.Src)
+	return wide
+}
+
+// rowPix returns the pixels of row y of img, four bytes per pixel from Rect.Min.X
+// to Rect.Max.X. Pixel x of the row starts at index 4*(x-img.Rect.Min.X).
+func rowPix(img *image.RGBA, y int) []uint8 {
+	i := img.PixOffset(img.Rect.Min.X, y)
+	return img.Pix[i : i+4*img.Rect.Dx()]
+}
+
+// rowPix64 returns the pixels of row y of img, eight bytes per pixel from Rect.Min.X
+// to Rect.Max.X. Pixel x of the row starts at index 8*(x-img.Rect.Min.X).
+func rowPix64(img *image.RGBA64, y int) []uint8 {
+	i := img.PixOffset(img.Rect.Min.X, y)
+	return img.Pix[i : i+8*img.Rect.Dx()]
+}
+
+// setNRGBA stores the non-premultiplied color (r, g, b, a) at index i of pix,
+// premultiplying it exactly like image.RGBA.Set does for a color.NRGBA.
+func setNRGBA(pix []uint8, i int, r, g, b, a uint8) {
+	pix[i+0] = premultiply(r, a)
+	pix[i+1] = premultiply(g, a)
+	pix[i+2] = premultiply(b, a)
+	pix[i+3] = a
+}
+
+// premultiply returns v multiplied by the alpha a, rounded like color.NRGBA.RGBA.
+func premultiply(v, a uint8) uint8 {
+	if a == 0xff {
+		return v
+	}
+	return uint8(uint32(v) * 0x101 * uint32(a) / 0xff >> 8)
+}
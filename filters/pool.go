@@ -0,0 +1,81 @@
+package filters
+
+import (
+	"image"
+	"image/color"
+	"sync"
+)
+
+// pixelGranule is the size step of pooled pixel buffers. Buffers are grouped by their
+// capacity rounded down to a multiple of it, so images of nearby sizes share buffers
+// while less than one granule is wasted per buffer.
+const pixelGranule = 64 << 10
+
+// pixelPools maps a size class, in granules, to the *sync.Pool of *[]uint8 buffers
+// holding at least that many granules.
+var pixelPools sync.Map
+
+// pixelPool returns the pool of buffers of the given size class.
+func pixelPool(class int) *sync.Pool {
+	if p, ok := pixelPools.Load(class); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := pixelPools.LoadOrStore(class, new(sync.Pool))
+	return p.(*sync.Pool)
+}
+
+// getPixels returns a zeroed buffer of n bytes, reused from the pool when possible.
+// Buffers smaller than a granule are not worth pooling and are always allocated.
+func getPixels(n int) []uint8 {
+	if n < pixelGranule {
+		return make([]uint8, n)
+	}
+	class := (n + pixelGranule - 1) / pixelGranule
+	if buf, ok := pixelPool(class).Get().(*[]uint8); ok {
+		pix := (*buf)[:n]
+		clear(pix)
+		return pix
+	}
+	return make([]uint8, n, class*pixelGranule)
+}
+
+// putPixels hands buf back to the pool. Buffers smaller than a granule are left to
+// the garbage collector.
+func putPixels(buf []uint8) {
+	class := cap(buf) / pixelGranule
+	if class == 0 {
+		return
+	}
+	buf = buf[:0]
+	pixelPool(class).Put(&buf)
+}
+
+// NewRGBA returns a transparent RGBA image with the given bounds, like image.NewRGBA,
+// but reuses the pixels of an image released with ReleaseRGBA when one of a suitable
+// size is available. Filters use it for their destination image, so the buffers of
+// one request are recycled by the next.
+func NewRGBA(r image.Rectangle) *image.RGBA {
+	return &image.RGBA{Pix: getPixels(4 * r.Dx() * r.Dy()), Stride: 4 * r.Dx(), Rect: r}
+}
+
+// ReleaseRGBA hands the pixels of img back for reuse by NewRGBA and NewPaletted.
+// img must own its whole pixel buffer, so it must not be a sub-image, and it must not
+// be used in any way once released. A nil img is ignored.
+func ReleaseRGBA(img *image.RGBA) {
+	if img != nil {
+		putPixels(img.Pix)
+	}
+}
+
+// NewPaletted is the paletted counterpart of NewRGBA: it returns an image like
+// image.NewPaletted, with every pixel set to index 0, reusing pooled pixels when possible.
+func NewPaletted(r image.Rectangle, p color.Palette) *image.Paletted {
+	return &image.Paletted{Pix: getPixels(r.Dx() * r.Dy()), Stride: r.Dx(), Rect: r, Palette: p}
+}
+
+// ReleasePaletted hands the pixels of img back for reuse, under the same rules as ReleaseRGBA.
+func ReleasePaletted(img *image.Paletted) {
+	if img != nil {
+		putPixels(img.Pix)
+	}
+}
@@ -0,0 +1,157 @@
+package filters
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// TestNewRGBAReturnsBlankImage checks that NewRGBA returns a transparent image of the
+// requested bounds, even when its pixels come from a released image that was drawn on.
+func TestNewRGBAReturnsBlankImage(t *testing.T) {
+	sizes := []image.Rectangle{
+		image.Rect(0, 0, 1, 1),
+		image.Rect(0, 0, 500, 375),
+		image.Rect(-3, 7, 260, 300),
+		image.Rect(0, 0, 128, 128), // exactly one granule
+		image.Rect(0, 0, 129, 128), // just over one granule
+	}
+	for round := 0; round < 3; round++ {
+		for _, r := range sizes {
+			img := NewRGBA(r)
+			if img.Rect != r || img.Stride != 4*r.Dx() || len(img.Pix) != 4*r.Dx()*r.Dy() {
+				t.Fatalf("NewRGBA(%v): got rect %v, stride %d, %d bytes", r, img.Rect, img.Stride, len(img.Pix))
+			}
+			for i, v := range img.Pix {
+				if v != 0 {
+					t.Fatalf("NewRGBA(%v): byte %d is %d, want 0", r, i, v)
+				}
+			}
+			for i := range img.Pix {
+				img.Pix[i] = 0xff
+			}
+			ReleaseRGBA(img)
+		}
+	}
+}
+
+// TestNewPalettedReturnsBlankImage is the paletted counterpart of TestNewRGBAReturnsBlankImage.
+func TestNewPalettedReturnsBlankImage(t *testing.T) {
+	palette := color.Palette{color.Transparent, color.Black}
+	for round := 0; round < 3; round++ {
+		for _, r := range []image.Rectangle{image.Rect(0, 0, 3, 2), image.Rect(0, 0, 700, 400)} {
+			img := NewPaletted(r, palette)
+			if img.Rect != r || img.Stride != r.Dx() || len(img.Pix) != r.Dx()*r.Dy() || len(img.Palette) != 2 {
+				t.Fatalf("NewPaletted(%v): got rect %v, stride %d, %d bytes", r, img.Rect, img.Stride, len(img.Pix))
+			}
+			for i, v := range img.Pix {
+				if v != 0 {
+					t.Fatalf("NewPaletted(%v): byte %d is %d, want 0", r, i, v)
+				}
+			}
+			for i := range img.Pix {
+				img.Pix[i] = 1
+			}
+			ReleasePaletted(img)
+		}
+	}
+}
+
+// TestReleaseNil checks that releasing nil images is a no-op.
+func TestReleaseNil(t *testing.T) {
+	ReleaseRGBA(nil)
+	ReleasePaletted(nil)
+}
+
+// TestPoolNeverSharesLiveBuffers checks, from many goroutines at once, that no two images
+// alive at the same time share pixels: each goroutine fills its images with its own value
+// and checks it is still there before releasing them.
+func TestPoolNeverSharesLiveBuffers(t *testing.T) {
+	const goroutines, rounds = 16, 50
+	sizes := []image.Rectangle{image.Rect(0, 0, 128, 128), image.Rect(0, 0, 200, 150), image.Rect(0, 0, 300, 300)}
+
+	var wg sync.WaitGroup
+	errs := make(chan string, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(mark uint8) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				rgba := NewRGBA(sizes[i%len(sizes)])
+				paletted := NewPaletted(sizes[(i+1)%len(sizes)], nil)
+				for j := range rgba.Pix {
+					rgba.Pix[j] = mark
+				}
+				for j := range paletted.Pix {
+					paletted.Pix[j] = mark
+				}
+				for j := range rgba.Pix {
+					if rgba.Pix[j] != mark {
+						errs <- "RGBA pixels written by another goroutine"
+						return
+					}
+				}
+				for j := range paletted.Pix {
+					if paletted.Pix[j] != mark {
+						errs <- "paletted pixels written by another goroutine"
+						return
+					}
+				}
+				ReleaseRGBA(rgba)
+				ReleasePaletted(paletted)
+			}
+		}(uint8(g + 1))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// TestPipelineConcurrentRuns checks that pipelines run concurrently, which release their
+// intermediate images to the pool, give the same output as when run alone: an image used
+// after being released would be overwritten by another run.
+func TestPipelineConcurrentRuns(t *testing.T) {
+	photo := samplePhoto(t)
+	specs := []string{"deepfry,pixelate:block=10,glitch", "anime_outline,negative,posterize", "poppink,greyscale,vaporwave"}
+
+	want := make([]string, len(specs))
+	pipelines := make([]Pipeline, len(specs))
+	for i, spec := range specs {
+		p, err := ParsePipeline(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipelines[i] = p
+		out, err := p.Apply(context.Background(), photo, rand.New(rand.NewSource(9)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[i] = digest(out)
+		ReleaseRGBA(out.(*image.RGBA))
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 12; g++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for round := 0; round < 3; round++ {
+				out, err := pipelines[i].Apply(context.Background(), photo, rand.New(rand.NewSource(9)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if digest(out) != want[i] {
+					t.Errorf("%s: concurrent run differs from a run alone", specs[i])
+				}
+				ReleaseRGBA(out.(*image.RGBA))
+			}
+		}(g % len(specs))
+	}
+	wg.Wait()
+}
@@ -1,46 +1,57 @@
 package filters
 
 import (
+	"context"
 	"image"
-	"image/color"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"math/rand"
 
 	_ "github.com/chai2010/webp"
 )
 
+func init() {
+	Register(New("posterize", "Reduces color depth to a flat retro look", []Param{
+		{Name: "levels", Description: "Number of levels kept per color channel", Integer: true, Default: 4, Min: 2, Max: 64},
+	}, func(ctx context.Context, img image.Image, args Args, _ *rand.Rand) (image.Image, error) {
+		return Posterize(ctx, img, args.Int("levels"))
+	}))
+}
+
 // Posterize applies a posterization effect to the given image by reducing the number of color levels.
 // The function processes each pixel, mapping its red, green, and blue channels to one of a fixed number
-// of discrete levels (in this case, 4). The result is an image with fewer distinct colors, creating a
+// of discrete levels (4 by default in the API). The result is an image with fewer distinct colors, creating a
 // stylized, poster-like appearance.
 //
 // Parameters:
-//   img image.Image - The source image to be posterized.
+//   - img image.Image - The source image to be posterized.
+//   - levels int - The number of levels kept per color channel.
 //
 // Returns:
-//   image.Image - A new image with the posterization effect applied.
-func Posterize(img image.Image) image.Image {
+//   - image.Image - A new image with the posterization effect applied.
+func Posterize(ctx context.Context, img image.Image, levels int) (image.Image, error) {
 	bounds := img.Bounds()
-	dst := image.NewRGBA(bounds)
-	levels := 4
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := img.At(x, y).RGBA()
+	src := rgbaOf(img)
+	dst := NewRGBA(bounds)
+	step := uint32(256 / levels)
 
-			r8 := uint8((r >> 8) / uint32(256/levels) * uint32(256/levels))
-			g8 := uint8((g >> 8) / uint32(256/levels) * uint32(256/levels))
-			b8 := uint8((b >> 8) / uint32(256/levels) * uint32(256/levels))
+	err := parallelRows(ctx, bounds, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			s, d := rowPix(src, y), rowPix(dst, y)
+			for i := 0; i < len(s); i += 4 {
+				r8 := uint8(uint32(s[i+0]) / step * step)
+				g8 := uint8(uint32(s[i+1]) / step * step)
+				b8 := uint8(uint32(s[i+2]) / step * step)
 
-			dst.Set(x, y, color.NRGBA{
-				R: r8,
-				G: g8,
-				B: b8,
-				A: uint8(a >> 8),
-			})
+				setNRGBA(d, i, r8, g8, b8, s[i+3])
+			}
 		}
+	})
+	if err != nil {
+		ReleaseRGBA(dst)
+		return nil, err
 	}
 
-	return dst
+	return dst, nil
 }
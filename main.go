@@ -1,25 +1,106 @@
 package main
 
 import (
+	"os"
+	"runtime"
+	"time"
+
+	"neko-love/config"
 	"neko-love/routes"
+	"neko-love/services"
+	"neko-love/services/admission"
 	"neko-love/services/cache"
+	"neko-love/services/fetcher"
+	"neko-love/services/jobs"
+	"neko-love/services/results"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-// main is the entry point of the application. It initializes a new Fiber web server,
+// main is the entry point of the application. It loads the configuration file (config.json,
+// or the path given by the NEKO_CONFIG environment variable), initializes a new Fiber web server,
 // starts watching for asset changes, sets up the application routes, and begins
 // listening for incoming HTTP requests on port 3030.
 func main() {
-	app := fiber.New()
+	configPath := os.Getenv("NEKO_CONFIG")
+	if configPath == "" {
+		configPath = "./config.json"
+	}
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		panic("Failed to load configuration: " + err.Error())
+	}
+
+	app := fiber.New(fiber.Config{
+		// Leave room for the multipart headers around an image of the maximum upload size.
+		BodyLimit: int(cfg.Filters.MaxUploadSize) + 64<<10,
+	})
 
 	cacheAssets, err := cache.New("./assets")
 	if err != nil {
 		panic("Failed to initialize image cache: " + err.Error())
 	}
 
+	hostPolicies := make(map[string]fetcher.HostPolicy, len(cfg.Fetch.Hosts))
+	for pattern, host := range cfg.Fetch.Hosts {
+		hostPolicies[pattern] = fetcher.HostPolicy{UserAgent: host.UserAgent, MaxSize: host.MaxSize}
+	}
+
+	imageFetcher := fetcher.New(fetcher.Options{
+		ConnectTimeout: time.Duration(cfg.Fetch.ConnectTimeout),
+		ReadTimeout:    time.Duration(cfg.Fetch.ReadTimeout),
+		MaxSize:        cfg.Fetch.MaxSize,
+		MaxRedirects:   cfg.Fetch.MaxRedirects,
+		AllowPrivate:   cfg.Fetch.AllowPrivate,
+		UserAgent:      cfg.Fetch.UserAgent,
+		AllowHosts:     cfg.Fetch.AllowHosts,
+		DenyHosts:      cfg.Fetch.DenyHosts,
+		Hosts:          hostPolicies,
+		CacheSize:      cfg.Fetch.CacheSize,
+	})
+
+	sources := fetcher.NewSources()
+	sources.Register("http", imageFetcher)
+	sources.Register("https", imageFetcher)
+	sources.Register("asset", fetcher.NewAssetSource(cacheAssets, cfg.Fetch.MaxSize))
+	sources.Register("data", fetcher.NewDataSource(cfg.Fetch.MaxSize))
+	if cfg.Fetch.FileRoot != "" {
+		sources.Register("file", fetcher.NewFileSource(cfg.Fetch.FileRoot, cfg.Fetch.MaxSize))
+	}
+
+	resultCache, err := results.New(results.Options{
+		MemorySize: cfg.Results.MemorySize,
+		DiskDir:    cfg.Results.DiskDir,
+		DiskSize:   cfg.Results.DiskSize,
+		Version:    services.RenderVersion(),
+	})
+	if err != nil {
+		panic("Failed to initialize result cache: " + err.Error())
+	}
+
+	capacity := cfg.Filters.Capacity
+	if capacity <= 0 {
+		capacity = 16 * runtime.GOMAXPROCS(0)
+	}
+	limiter := admission.New(int64(capacity), cfg.Filters.QueueSize, time.Duration(cfg.Filters.QueueTimeout))
+
+	jobManager := jobs.New(jobs.Options{
+		Workers:     cfg.Jobs.Workers,
+		QueueSize:   cfg.Jobs.QueueSize,
+		Timeout:     time.Duration(cfg.Jobs.Timeout),
+		TTL:         time.Duration(cfg.Jobs.TTL),
+		ResultsSize: cfg.Jobs.ResultsSize,
+	})
+
 	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("config", cfg)
 		c.Locals("cacheAssets", cacheAssets)
+		c.Locals("sources", sources)
+		c.Locals("fetcher", imageFetcher)
+		c.Locals("resultCache", resultCache)
+		c.Locals("limiter", limiter)
+		c.Locals("jobs", jobManager)
 		return c.Next()
 	})
 
@@ -0,0 +1,376 @@
+package routes
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"neko-love/config"
+	"neko-love/filters"
+	"neko-love/services"
+	"neko-love/services/admission"
+	"neko-love/services/fetcher"
+	"neko-love/services/results"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// batchRequest is the JSON body of a batch request.
+type batchRequest struct {
+	// Images are the images to filter, referenced as by the "image" query parameter.
+	Images []string `json:"images"`
+	// Pipelines are the filter pipelines to apply, written as the "steps" query parameter.
+	Pipelines []string `json:"pipelines"`
+}
+
+// batchHandler handles POST /filters/batch, which applies every pipeline of the request to
+// every one of its images and returns the results as a ZIP archive, so a client needing
+// many renderings makes a single request. The archive is streamed: its entries are written
+// in the order the renderings complete, while the others are still in progress.
+//
+// Each image is filtered as by "/filters/chain", with the same limits, result cache and
+// admission, and within the configured filters.timeout. An item that fails does not fail
+// the batch: its entry is a JSON file holding the error response the filter endpoints
+// would have given for it. The archive ends with "manifest.json", which lists every item
+// in order. The request itself is rejected, before anything is rendered, when its body,
+// a pipeline or an output option is invalid, or when it asks for more than the configured
+// filters.max_batch_items renderings. Its body is read as received, up to the configured
+// filters.max_upload_size, and refused when compressed (see rawBody).
+//
+// Route:
+//
+//	POST /filters/batch[?seed=<seed>&format=<format>&quality=<quality>&palette=<palette>&dither=<dither>]
+//
+// Parameters:
+//   - images: The URLs of the images to process (JSON body). Uploads are not supported; data URLs
+//     can carry images inline.
+//   - pipelines: The filter pipelines, e.g. "deepfry,pixelate:block=10" (JSON body).
+//   - seed, format, quality, palette, dither: As for the filter endpoints, applied to every item
+//     (query parameters). The Accept header is ignored.
+//
+// Archive entries, for the image at index i and the pipeline at index j, both zero-padded:
+//   - i-j.<format>: the filtered image;
+//   - i-j.error.json: the error of a failed item, with its image, pipeline and HTTP status;
+//   - manifest.json: an "items" array of objects with file, image, pipeline, status, and
+//     code and error for failed items.
+func batchHandler(c *fiber.Ctx) error {
+	cfg := c.Locals("config").(*config.Config)
+	raw, err := rawBody(c)
+	if err != nil {
+		return err
+	}
+	if maxSize := cfg.Filters.MaxUploadSize; int64(len(raw)) > maxSize {
+		return fiber.NewError(fiber.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Request body exceeds the maximum upload size of %d bytes", maxSize))
+	}
+
+	var body batchRequest
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Request body must be a JSON object with 'images' and 'pipelines' arrays")
+	}
+	if len(body.Images) == 0 || len(body.Pipelines) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Batch must have at least one image and one pipeline")
+	}
+
+	items := len(body.Images) * len(body.Pipelines)
+	if maxItems := cfg.Filters.MaxBatchItems; maxItems > 0 && items > maxItems {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": fmt.Sprintf("batch of %d items exceeds the maximum of %d", items, maxItems),
+			"code":  "batch_too_large",
+		})
+	}
+
+	pipelines := make([]filters.Pipeline, len(body.Pipelines))
+	for i, steps := range body.Pipelines {
+		pipeline, err := filters.ParsePipeline(steps)
+		if err != nil {
+			status, errBody, ok := pipelineErrorBody(err)
+			if !ok {
+				status, errBody = fiber.StatusBadRequest, fiber.Map{"error": err.Error()}
+			}
+			errBody["pipeline"] = i
+			return c.Status(status).JSON(errBody)
+		}
+		pipelines[i] = pipeline
+	}
+
+	seed, err := requestSeed(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+			"param": "seed",
+		})
+	}
+
+	// Output options are checked once for all items; the image format only matters
+	// to pick the default output format.
+	params := outputParams{
+		format:  c.Query("format"),
+		quality: c.Query("quality"),
+		palette: c.Query("palette"),
+		dither:  c.Query("dither"),
+	}
+	if _, err := services.NegotiateOutput(params.format, params.quality, "", "png", false); err != nil {
+		return outputError(c, err)
+	}
+	if _, err := services.ParseGIFOptions(params.palette, params.dither); err != nil {
+		return outputError(c, err)
+	}
+
+	b := &batch{
+		images:    body.Images,
+		pipelines: pipelines,
+		seed:      seed,
+		seeded:    c.Query("seed") != "",
+		params:    params,
+		cfg:       cfg,
+		sources:   c.Locals("sources").(*fetcher.Sources),
+		limiter:   c.Locals("limiter").(*admission.Limiter),
+		cache:     c.Locals("resultCache").(*results.Cache),
+		socket:    socketOf(c),
+	}
+
+	c.Locals("noCache", true)
+	c.Set("X-Filter-Seed", strconv.FormatInt(seed, 10))
+	c.Attachment("filtered.zip")
+	// The stream is written once the handler has returned: it must not use c.
+	c.Context().SetBodyStreamWriter(b.write)
+	return nil
+}
+
+// batch is a validated batch request, rendered while its response is written.
+type batch struct {
+	images    []string
+	pipelines []filters.Pipeline
+	seed      int64
+	// seeded tells whether the seed was given by the client, which makes the results
+	// of random pipelines cacheable.
+	seeded bool
+	params outputParams
+
+	cfg     *config.Config
+	sources *fetcher.Sources
+	limiter *admission.Limiter
+	cache   *results.Cache
+	// socket is the connection of the client, watched for disconnects while the
+	// archive is written, or nil when it cannot be (see watchDisconnect).
+	socket syscall.RawConn
+}
+
+// batchItem is the rendering of the image at index image with the pipeline at index pipeline.
+type batchItem struct {
+	image, pipeline int
+}
+
+// batchResult is the outcome of a batchItem: the rendered body and output options, or the
+// status and JSON body of its error.
+type batchResult struct {
+	item    batchItem
+	body    []byte
+	opts    services.OutputOptions
+	status  int
+	errBody fiber.Map
+}
+
+// write renders the items of the batch, on one worker per available CPU, and writes the
+// archive to w as they complete. When the client closes its connection, or writing
+// fails, the client is gone: the renderings in progress are cancelled, no other item is
+// started and the archive is left unfinished.
+func (b *batch) write(w *bufio.Writer) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if b.socket != nil {
+		// The archive is only sent as entries complete, so a disconnect would go
+		// unnoticed until then without watching the connection.
+		defer watchSocket(ctx, cancel, b.socket)()
+	}
+
+	items := make(chan batchItem)
+	go func() {
+		defer close(items)
+		for i := range b.images {
+			for j := range b.pipelines {
+				select {
+				case items <- batchItem{image: i, pipeline: j}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	completed := make(chan batchResult)
+	var wg sync.WaitGroup
+	for range min(runtime.GOMAXPROCS(0), len(b.images)*len(b.pipelines)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range items {
+				select {
+				case completed <- b.render(ctx, item):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(completed)
+	}()
+
+	zw := zip.NewWriter(w)
+	manifest := make([]fiber.Map, len(b.images)*len(b.pipelines))
+	for result := range completed {
+		if ctx.Err() != nil {
+			return
+		}
+		entry, err := b.writeResult(zw, result)
+		if err == nil {
+			err = flush(zw, w)
+		}
+		if err != nil {
+			return
+		}
+		manifest[result.item.image*len(b.pipelines)+result.item.pipeline] = entry
+	}
+
+	if err := writeJSONEntry(zw, "manifest.json", fiber.Map{"items": manifest}); err != nil {
+		return
+	}
+	if err := zw.Close(); err != nil {
+		return
+	}
+	w.Flush()
+}
+
+// render loads the image of item and renders it as filterImage does, returning the error
+// response for it when it fails.
+func (b *batch) render(ctx context.Context, item batchItem) batchResult {
+	if timeout := time.Duration(b.cfg.Filters.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	result := batchResult{item: item}
+	pipeline := b.pipelines[item.pipeline]
+	body, opts, err := func() ([]byte, services.OutputOptions, error) {
+		data, err := b.sources.Load(ctx, b.images[item.image])
+		if err != nil {
+			return nil, services.OutputOptions{}, err
+		}
+		req, err := newRenderRequest(b.cfg, pipeline, data, b.seed, b.params)
+		if err != nil {
+			return nil, services.OutputOptions{}, err
+		}
+
+		render := admittedRender(b.limiter, req)
+		if pipeline.Random() && !b.seeded {
+			body, err := render(ctx)
+			return body, req.opts, err
+		}
+		key := resultKey(pipeline, req.data, req.seed, req.size, req.opts)
+		body, _, err := b.cache.Render(ctx, key, render)
+		return body, req.opts, err
+	}()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		result.status, result.errBody = batchErrorBody(err)
+		return result
+	}
+
+	result.body, result.opts, result.status = body, opts, fiber.StatusOK
+	return result
+}
+
+// writeResult writes the entry of result to the archive and returns its manifest entry.
+func (b *batch) writeResult(zw *zip.Writer, result batchResult) (fiber.Map, error) {
+	name := b.entryName(result.item)
+	entry := fiber.Map{
+		"image":    result.item.image,
+		"pipeline": result.item.pipeline,
+		"status":   result.status,
+	}
+
+	if result.errBody != nil {
+		entry["file"] = name + ".error.json"
+		entry["error"] = result.errBody["error"]
+		if code, ok := result.errBody["code"]; ok {
+			entry["code"] = code
+		}
+
+		result.errBody["image"] = result.item.image
+		result.errBody["pipeline"] = result.item.pipeline
+		result.errBody["status"] = result.status
+		return entry, writeJSONEntry(zw, entry["file"].(string), result.errBody)
+	}
+
+	entry["file"] = name + "." + result.opts.Format
+	// Images are compressed already: they are stored as is.
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: entry["file"].(string), Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	_, err = fw.Write(result.body)
+	return entry, err
+}
+
+// entryName returns the name of the archive entries of item, without extension: the
+// indexes of its image and pipeline, zero-padded so the entries sort in order.
+func (b *batch) entryName(item batchItem) string {
+	imageWidth := len(strconv.Itoa(len(b.images) - 1))
+	pipelineWidth := len(strconv.Itoa(len(b.pipelines) - 1))
+	return fmt.Sprintf("%0*d-%0*d", imageWidth, item.image, pipelineWidth, item.pipeline)
+}
+
+// writeJSONEntry writes v as the JSON archive entry name.
+func writeJSONEntry(zw *zip.Writer, name string, v any) error {
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(fw).Encode(v)
+}
+
+// flush sends the entries written to the archive so far to the client.
+func flush(zw *zip.Writer, w *bufio.Writer) error {
+	if err := zw.Flush(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// batchErrorBody returns the status and JSON body of the response the filter endpoints
+// give for err: see fetchError, limitError, outputError and processingError.
+func batchErrorBody(err error) (int, fiber.Map) {
+	var fetchErr *fetcher.Error
+	var limitErr *services.LimitError
+	var optErr *services.OutputError
+	var fiberErr *fiber.Error
+	switch {
+	case errors.As(err, &fetchErr):
+		return fetchErrorBody(fetchErr)
+	case errors.As(err, &limitErr):
+		return fiber.StatusUnprocessableEntity, limitErrorBody(limitErr)
+	case errors.As(err, &optErr):
+		return fiber.StatusBadRequest, fiber.Map{"error": err.Error(), "param": optErr.Param}
+	case errors.As(err, &fiberErr):
+		return fiberErr.Code, fiber.Map{"error": fiberErr.Message}
+	}
+
+	if status, body, ok := processingErrorBody(err); ok {
+		return status, body
+	}
+	return fiber.StatusInternalServerError, fiber.Map{"error": "Failed to process image"}
+}
@@ -0,0 +1,208 @@
+package routes
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"neko-love/config"
+	"neko-love/services/admission"
+	"neko-love/services/fetcher"
+	"neko-love/services/results"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// testApp returns an app serving the filter routes with cfg, loading images from data
+// URLs only.
+func testApp(t *testing.T, cfg *config.Config) *fiber.App {
+	t.Helper()
+	sources := fetcher.NewSources()
+	sources.Register("data", fetcher.NewDataSource(cfg.Fetch.MaxSize))
+	resultCache, err := results.New(results.Options{MemorySize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := admission.New(16, 16, time.Second)
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("config", cfg)
+		c.Locals("sources", sources)
+		c.Locals("resultCache", resultCache)
+		c.Locals("limiter", limiter)
+		return c.Next()
+	})
+	RegisterFilterRoutes(app.Group("/api/v4"))
+	return app
+}
+
+// pngDataURL returns a data URL holding a small PNG image.
+func pngDataURL(t *testing.T) string {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	img.SetRGBA(0, 0, color.RGBA{0xff, 0, 0, 0xff})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// postBatch posts a batch request for images and pipelines to app.
+func postBatch(t *testing.T, app *fiber.App, images, pipelines []string) (int, []byte) {
+	t.Helper()
+	body, err := json.Marshal(batchRequest{Images: images, Pipelines: pipelines})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(fiber.MethodPost, "/api/v4/filters/batch?seed=1", bytes.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+type manifestItem struct {
+	File     string `json:"file"`
+	Image    int    `json:"image"`
+	Pipeline int    `json:"pipeline"`
+	Status   int    `json:"status"`
+	Code     string `json:"code"`
+	Error    string `json:"error"`
+}
+
+// TestBatch checks the archive of a batch: its entries, zero-padded so they sort in
+// order, the error entries of the failed items, and the manifest listing every item in
+// order.
+func TestBatch(t *testing.T) {
+	app := testApp(t, config.Default())
+	valid := pngDataURL(t)
+	invalid := "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte("not an image"))
+	images := make([]string, 11)
+	for i := range images {
+		images[i] = valid
+	}
+	images[3] = invalid
+	images[7] = "nope://neko.png"
+	pipelines := []string{"negative", "pixelate:block=2"}
+
+	status, body := postBatch(t, app, images, pipelines)
+	if status != fiber.StatusOK {
+		t.Fatalf("got status %d: %s", status, body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string][]byte)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		entries[f.Name] = data
+	}
+	if last := zr.File[len(zr.File)-1].Name; last != "manifest.json" {
+		t.Fatalf("the archive ends with %s, want manifest.json", last)
+	}
+	if len(entries) != len(images)*len(pipelines)+1 {
+		t.Fatalf("the archive has %d entries, want %d", len(entries), len(images)*len(pipelines)+1)
+	}
+
+	var manifest struct {
+		Items []manifestItem `json:"items"`
+	}
+	if err := json.Unmarshal(entries["manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Items) != len(images)*len(pipelines) {
+		t.Fatalf("the manifest lists %d items, want %d", len(manifest.Items), len(images)*len(pipelines))
+	}
+	for n, item := range manifest.Items {
+		i, j := n/len(pipelines), n%len(pipelines)
+		if item.Image != i || item.Pipeline != j {
+			t.Fatalf("manifest item %d is for image %d and pipeline %d, want %d and %d", n, item.Image, item.Pipeline, i, j)
+		}
+		name := fmt.Sprintf("%02d-%d", i, j)
+		data, ok := entries[item.File]
+		if !ok {
+			t.Fatalf("manifest item %d names %s, which is not in the archive", n, item.File)
+		}
+
+		if images[i] == valid {
+			if item.File != name+".png" || item.Status != fiber.StatusOK || item.Error != "" {
+				t.Errorf("item %s: got %+v, want a PNG", name, item)
+			}
+			if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+				t.Errorf("item %s: %v", name, err)
+			}
+			continue
+		}
+
+		if item.File != name+".error.json" || item.Status < 400 || item.Error == "" {
+			t.Errorf("item %s: got %+v, want an error entry", name, item)
+			continue
+		}
+		var errBody manifestItem
+		if err := json.Unmarshal(data, &errBody); err != nil {
+			t.Fatalf("item %s: %v", name, err)
+		}
+		if errBody.Image != i || errBody.Pipeline != j || errBody.Status != item.Status || errBody.Error != item.Error || errBody.Code != item.Code {
+			t.Errorf("item %s: error entry %+v does not match the manifest %+v", name, errBody, item)
+		}
+	}
+}
+
+// TestBatchTooLarge checks that a batch asking for more renderings than allowed is
+// refused before anything is rendered.
+func TestBatchTooLarge(t *testing.T) {
+	cfg := config.Default()
+	cfg.Filters.MaxBatchItems = 4
+	app := testApp(t, cfg)
+	image := pngDataURL(t)
+
+	if status, body := postBatch(t, app, []string{image, image}, []string{"negative", "blurple"}); status != fiber.StatusOK {
+		t.Fatalf("batch at the limit: got status %d: %s", status, body)
+	}
+
+	status, body := postBatch(t, app, []string{image, image, image}, []string{"negative", "blurple"})
+	if status != fiber.StatusUnprocessableEntity {
+		t.Fatalf("got status %d, want 422: %s", status, body)
+	}
+	var errBody struct {
+		Code  string `json:"code"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errBody); err != nil {
+		t.Fatal(err)
+	}
+	if errBody.Code != "batch_too_large" || !strings.Contains(errBody.Error, "6 items") {
+		t.Fatalf("got %+v, want batch_too_large", errBody)
+	}
+}
@@ -2,100 +2,737 @@ package routes
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/gif"
 	"io"
-	"net/http"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"neko-love/config"
+	"neko-love/filters"
 	"neko-love/services"
+	"neko-love/services/admission"
+	"neko-love/services/fetcher"
+	"neko-love/services/results"
 
 	"github.com/gofiber/fiber/v2"
 )
 
 // RegisterFilterRoutes registers the filter-related API routes to the provided Fiber router.
 // It defines a GET endpoint "/filters/:filter" that applies the specified image filter to an image
-// provided via the "image" query parameter. The endpoint supports GIF images with special handling
-// and applies the requested filter to other image formats. The processed image is returned in the
-// original format. Returns appropriate HTTP errors for missing parameters or processing failures.
+// provided via the "image" query parameter, and a GET endpoint "/filters/chain" that applies several
+// filters in order on a single decode of the image. The endpoints support GIF images with special
+// handling and apply the requested filters to other image formats. The processed image is returned
+// in the original format unless another one is requested with the "format" query parameter or
+// preferred by the Accept header; the chosen format and quality are reported in the X-Image-Format
+// and X-Image-Quality headers. Filters are resolved through the filters registry; an unknown filter name
+// results in a 404 JSON response listing the closest registered filter names.
+// Filter parameters are validated against the filter's schema; a malformed or out-of-range value
+// results in a 400 JSON response naming the parameter.
+// Random filters are driven by the "seed" query parameter so a result can be reproduced;
+// when it is omitted a random seed is picked. The seed used is echoed in the X-Filter-Seed header.
+// Deterministic results are cached and carry an ETag, so repeated requests are answered from
+// the cache and conditional ones with 304 Not Modified.
+// The POST variants take the image itself instead of its URL, either as the raw request body or as
+// the "image" field of a multipart form, up to the configured maximum upload size; everything else
+// works as with GET. POST "/filters/batch" applies several pipelines to several images at once and
+// streams the results as a ZIP archive (see batchHandler).
+// Returns appropriate HTTP errors for missing parameters or processing failures.
 //
 // Routes:
-//   GET /filters/:filter?image=<image_url>
+//
+//	GET  /filters
+//	GET  /filters/chain?image=<image_url>&steps=<filter>[:<param>=<value>...][,<filter>...]
+//	GET  /filters/:filter?image=<image_url>[&<param>=<value>...]
+//	POST /filters/chain?steps=<filter>[:<param>=<value>...][,<filter>...]
+//	POST /filters/batch (see batchHandler)
+//	POST /filters/:filter[?<param>=<value>...]
 //
 // Parameters:
 //   - filter: The name of the filter to apply (path parameter).
-//   - image:  The URL of the image to process (query parameter).
+//   - image:  The URL of the image to process (query parameter), or else for POST requests the
+//     uploaded image (raw body or multipart form field).
+//   - steps:  The comma-separated filter pipeline, e.g. deepfry,pixelate:block=10,glitch (query parameter).
+//   - seed:   Optional 64-bit integer seeding the random filters (query parameter).
+//   - format:  Optional output format, one of png, jpeg, webp or gif (query parameter).
+//   - quality: Optional lossy quality from 1 to 100 for jpeg and webp output (query parameter); see
+//     services.NegotiateOutput for the defaults.
+//   - palette: Optional GIF palette mode, frame (default) or global (query parameter).
+//   - dither:  Optional GIF dithering, floyd (default), ordered or none (query parameter).
+//   - param:  Any parameter declared by the filter, e.g. block for pixelate (query parameters).
 func RegisterFilterRoutes(router fiber.Router) {
-	router.Get("/filters/:filter", func(c *fiber.Ctx) error {
-		filter := c.Params("filter")
-		if filter == "" {
-			return fiber.ErrNotFound
-		}
+	router.Get("/filters", listFilters)
 
-		imageURL := c.Query("image")
-		if imageURL == "" {
-			return fiber.NewError(fiber.StatusBadRequest, "Image URL is required")
-		}
+	router.Get("/filters/chain", chainHandler)
+	router.Post("/filters/chain", chainHandler)
+	router.Post("/filters/batch", batchHandler)
+
+	router.Get("/filters/:filter", filterHandler)
+	router.Post("/filters/:filter", filterHandler)
+}
+
+// chainHandler handles GET and POST /filters/chain, applying the pipeline given by
+// the "steps" query parameter.
+func chainHandler(c *fiber.Ctx) error {
+	pipeline, err := filters.ParsePipeline(c.Query("steps"))
+	if err != nil {
+		return pipelineError(c, err)
+	}
+
+	return filterImage(c, pipeline)
+}
+
+// filterHandler handles GET and POST /filters/:filter, applying the named filter with
+// the parameters given in the query string.
+func filterHandler(c *fiber.Ctx) error {
+	name := c.Params("filter")
+	if name == "" {
+		return fiber.ErrNotFound
+	}
+
+	filter, ok := filters.Lookup(name)
+	if !ok {
+		return pipelineError(c, &filters.UnknownFilterError{Name: name, Suggestions: filters.Suggest(name)})
+	}
+
+	args, err := filters.ParseArgs(filter, c.Queries())
+	if err != nil {
+		return pipelineError(c, err)
+	}
+
+	return filterImage(c, filters.Single(filter, args))
+}
+
+// filterImage reads the source image of the request (see requestImage), applies the pipeline to it
+// and writes the result to the response in the negotiated output format (see renderImage).
+//
+// Deterministic results, those of pipelines without random filters or with an explicit seed,
+// are kept in the result cache under a key made of the source bytes, the pipeline and the output
+// options. Their response carries a strong ETag derived from that key, is answered with
+// 304 Not Modified when it matches If-None-Match, and reports with X-Cache whether it was cached,
+// rendered, or shared with an identical request rendered at the same time (see results.Cache.Render).
+// Random results are neither cached nor cacheable by clients.
+//
+// The request is processed within the configured filters.timeout: past it, the work stops
+// between rows or frames and the request fails with 504 (see processingError). It stops as
+// well once the client has disconnected (see watchDisconnect). Rendering is admitted by the
+// admission.Limiter of the server, weighing 1 for a still image and 1 per frame for an
+// animation; when it is saturated the request fails with 503.
+func filterImage(c *fiber.Ctx, pipeline filters.Pipeline) error {
+	stopWatching := watchDisconnect(c)
+	defer stopWatching()
+	cancel := applyTimeout(c)
+	defer cancel()
+
+	req, err := parseRenderRequest(c, pipeline)
+	if req == nil {
+		return err
+	}
+
+	c.Vary(fiber.HeaderAccept)
+	c.Set("X-Filter-Seed", strconv.FormatInt(req.seed, 10))
+
+	render := admittedRender(c.Locals("limiter").(*admission.Limiter), req)
 
-		data, err := fetchImage(imageURL)
+	if pipeline.Random() && c.Query("seed") == "" {
+		c.Locals("noCache", true)
+		body, err := render(c.UserContext())
 		if err != nil {
-			return fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch image")
+			return processingError(c, err)
 		}
+		services.SetOutputHeaders(c, req.opts)
+		return c.Send(body)
+	}
 
-		format := http.DetectContentType(data)
-		c.Locals("noCache", true)
+	key := resultKey(pipeline, req.data, req.seed, req.size, req.opts)
+	c.Set(fiber.HeaderETag, key.ETag())
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	if (c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead) && c.Fresh() {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	body, origin, err := c.Locals("resultCache").(*results.Cache).Render(c.UserContext(), key, render)
+	if err != nil {
+		return processingError(c, err)
+	}
+
+	c.Set("X-Cache", string(origin))
+	services.SetOutputHeaders(c, req.opts)
+	return c.Send(body)
+}
 
-		if strings.HasPrefix(format, "image/gif") {
-			return handleGIF(c, filter, data)
+// applyTimeout bounds the context of the request by the configured filters.timeout, if any.
+// The returned function releases the resources of the deadline once the request is done.
+func applyTimeout(c *fiber.Ctx) context.CancelFunc {
+	timeout := time.Duration(c.Locals("config").(*config.Config).Filters.Timeout)
+	if timeout <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), timeout)
+	c.SetUserContext(ctx)
+	return cancel
+}
+
+// renderRequest is a rendering asked for by a request, once validated by parseRenderRequest.
+type renderRequest struct {
+	pipeline filters.Pipeline
+	data     []byte
+	seed     int64
+	animated bool
+	// frames is the number of frames rendered: every frame of an animation kept as a GIF,
+	// and 1 otherwise.
+	frames int
+	size   image.Point
+	opts   services.OutputOptions
+}
+
+// render renders the image, as described by renderImage.
+func (r *renderRequest) render(ctx context.Context) ([]byte, error) {
+	return renderImage(ctx, r.pipeline, r.data, r.seed, r.animated, r.size, r.opts)
+}
+
+// admittedRender returns a function rendering req once the limiter admits it, weighing
+// its number of frames. Only actual renderings take capacity, not cached results or
+// renderings shared with identical requests.
+func admittedRender(limiter *admission.Limiter, req *renderRequest) func(ctx context.Context) ([]byte, error) {
+	return func(ctx context.Context) ([]byte, error) {
+		release, err := limiter.Acquire(ctx, int64(req.frames))
+		if err != nil {
+			return nil, err
 		}
+		defer release()
+		return req.render(ctx)
+	}
+}
 
-		srcImg, formatStr, err := image.Decode(bytes.NewReader(data))
+// parseRenderRequest reads the seed, the source image (see requestImage) and the output
+// options of the request, and checks the image against the decode limits. When any of them
+// is invalid, it writes the error response and returns a nil request, along with the error
+// the handler must return.
+func parseRenderRequest(c *fiber.Ctx, pipeline filters.Pipeline) (*renderRequest, error) {
+	seed, err := requestSeed(c)
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+			"param": "seed",
+		})
+	}
+
+	data, err := requestImage(c)
+	if err != nil {
+		return nil, fetchError(c, err)
+	}
+
+	req, err := newRenderRequest(c.Locals("config").(*config.Config), pipeline, data, seed, outputParams{
+		format:  c.Query("format"),
+		quality: c.Query("quality"),
+		accept:  c.Get(fiber.HeaderAccept),
+		palette: c.Query("palette"),
+		dither:  c.Query("dither"),
+	})
+	var limitErr *services.LimitError
+	var optErr *services.OutputError
+	switch {
+	case errors.As(err, &limitErr):
+		return nil, limitError(c, err)
+	case errors.As(err, &optErr), errors.Is(err, services.ErrNotAcceptable):
+		return nil, outputError(c, err)
+	case err != nil:
+		return nil, err
+	}
+	return req, nil
+}
+
+// outputParams are the output options given by a request, as in the query parameters
+// and Accept header of the filter endpoints.
+type outputParams struct {
+	format, quality, accept string
+	palette, dither         string
+}
+
+// newRenderRequest validates the rendering of data with the pipeline, the seed and the
+// output options given by params. It returns an *services.OutputError or
+// services.ErrNotAcceptable for invalid output options, a *services.LimitError for an
+// image exceeding the decode limits, and a Fiber error for an image that cannot be decoded.
+func newRenderRequest(cfg *config.Config, pipeline filters.Pipeline, data []byte, seed int64, params outputParams) (*renderRequest, error) {
+	limits := decodeLimits(cfg)
+	info, err := services.InspectImage(data, limits.MaxFrames)
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	animated := info.Format == "gif"
+
+	opts, err := services.NegotiateOutput(params.format, params.quality, params.accept, info.Format, animated)
+	if err != nil {
+		return nil, err
+	}
+	if opts.GIF, err = services.ParseGIFOptions(params.palette, params.dither); err != nil {
+		return nil, err
+	}
+	opts.GIF.Workers = cfg.Filters.GIFWorkers
+
+	if !animated || opts.Format != "gif" {
+		// Only the first frame of a GIF is decoded when it is not kept animated.
+		info.Frames = 1
+	}
+	size, err := limits.Check(info)
+	if err != nil {
+		return nil, err
+	}
+	opts.GIF.Size = size
+
+	return &renderRequest{
+		pipeline: pipeline,
+		data:     data,
+		seed:     seed,
+		animated: animated,
+		frames:   info.Frames,
+		size:     size,
+		opts:     opts,
+	}, nil
+}
+
+// resultKey returns the result cache key of the image rendered from the source data with
+// the pipeline, seed, downscaled size and output options, by the running version of the
+// server (see services.RenderVersion), so an upgrade never serves the renderings of the
+// previous code. The seed is only part of the key for random pipelines, since it does not
+// change the output of the others.
+func resultKey(pipeline filters.Pipeline, data []byte, seed int64, size image.Point, opts services.OutputOptions) results.Key {
+	seedPart := ""
+	if pipeline.Random() {
+		seedPart = strconv.FormatInt(seed, 10)
+	}
+	return results.NewKey(data,
+		services.RenderVersion(),
+		pipeline.String(),
+		seedPart,
+		size.String(),
+		opts.Format,
+		strconv.Itoa(opts.Quality),
+		string(opts.GIF.Palette),
+		string(opts.GIF.Dither),
+	)
+}
+
+// renderImage applies the pipeline to the source image data and returns the result encoded
+// as described by opts. Animated GIFs kept as GIF are processed frame by frame through renderGIF;
+// other images are decoded once, filtered and encoded. A GIF converted to another format is
+// rendered from its first frame. When size is not zero, the image is scaled down to it before
+// being filtered (see services.Limits); opts.GIF.Size does the same for animations.
+// Once ctx is done, rendering stops and ctx.Err() is returned.
+func renderImage(ctx context.Context, pipeline filters.Pipeline, data []byte, seed int64, animated bool, size image.Point, opts services.OutputOptions) ([]byte, error) {
+	if animated && opts.Format == "gif" {
+		return renderGIF(ctx, pipeline, data, seed, opts.GIF)
+	}
+
+	srcImg, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	if size != (image.Point{}) {
+		scaled, err := services.Downscale(ctx, srcImg, size)
+		services.ReleaseImage(srcImg)
 		if err != nil {
-			return fiber.NewError(fiber.StatusInternalServerError, "Failed to decode image")
+			return nil, err
 		}
+		srcImg = scaled
+	}
+
+	result, err := services.ApplyFilter(ctx, pipeline, srcImg, seed)
+	if err != nil {
+		services.ReleaseImage(srcImg)
+		return nil, err
+	}
+	defer services.ReleaseImage(result)
+	if result != srcImg {
+		defer services.ReleaseImage(srcImg)
+	}
+
+	var buf bytes.Buffer
+	if err := services.Encode(&buf, result, opts); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-		result := services.ApplyFilter(filter, srcImg)
-		return services.EncodeAndSetContentType(c, result, formatStr)
+// decodeError returns the Fiber error reporting an image given by the client that cannot be
+// decoded: 415 Unsupported Media Type when its format is unknown, and 400 when it is malformed.
+func decodeError(err error) error {
+	if errors.Is(err, image.ErrFormat) {
+		return fiber.NewError(fiber.StatusUnsupportedMediaType, "Image format is not supported")
+	}
+	return fiber.NewError(fiber.StatusBadRequest, "Image data is malformed")
+}
+
+// decodeLimits returns the limits applied to the images given to the filter endpoints.
+func decodeLimits(cfg *config.Config) services.Limits {
+	return services.Limits{
+		MaxWidth:  cfg.Filters.MaxWidth,
+		MaxHeight: cfg.Filters.MaxHeight,
+		MaxPixels: int64(cfg.Filters.MaxMegapixels * 1e6),
+		MaxFrames: cfg.Filters.MaxFrames,
+		Downscale: cfg.Filters.Downscale,
+	}
+}
+
+// limitError writes the response for an error returned by services.Limits.Check:
+// 422 Unprocessable Entity with code "image_too_large", naming the exceeded limit.
+func limitError(c *fiber.Ctx, err error) error {
+	var limitErr *services.LimitError
+	if !errors.As(err, &limitErr) {
+		return err
+	}
+
+	return c.Status(fiber.StatusUnprocessableEntity).JSON(limitErrorBody(limitErr))
+}
+
+// limitErrorBody returns the JSON body reporting err, as written by limitError.
+func limitErrorBody(err *services.LimitError) fiber.Map {
+	return fiber.Map{
+		"error": err.Error(),
+		"code":  "image_too_large",
+		"limit": err.Limit,
+	}
+}
+
+// outputError writes the response for an error returned by services.NegotiateOutput:
+// 400 naming the parameter for an invalid format or quality, and 406 when the Accept
+// header rules out every supported format.
+func outputError(c *fiber.Ctx, err error) error {
+	var optErr *services.OutputError
+	if errors.As(err, &optErr) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+			"param": optErr.Param,
+		})
+	}
+
+	return fiber.NewError(fiber.StatusNotAcceptable, err.Error())
+}
+
+// fetchError writes the JSON response for an error returned while loading the image
+// given by URL. The status tells clients whose fault it is, and the "code" field, one of
+// the fetcher.Code values, what went wrong:
+//   - 400 invalid_url, unsupported_scheme or forbidden_address for an unusable URL;
+//   - 404 not_found for a local image that does not exist;
+//   - 403 host_not_allowed when the host is not in the configured allow list or is denied;
+//   - 502 upstream_status (with the status in "upstream_status") or upstream_error when
+//     the image host fails;
+//   - 504 timeout when it does not answer in time;
+//   - 413 too_large and 415 unsupported_type when the response is not an acceptable image.
+//
+// Other errors, and any error once the request context is done, are reported by processingError.
+func fetchError(c *fiber.Ctx, err error) error {
+	if ctxErr := c.UserContext().Err(); ctxErr != nil {
+		return processingError(c, ctxErr)
+	}
+
+	var fetchErr *fetcher.Error
+	if !errors.As(err, &fetchErr) {
+		return processingError(c, err)
+	}
+
+	status, body := fetchErrorBody(fetchErr)
+	return c.Status(status).JSON(body)
+}
+
+// fetchErrorBody returns the status and JSON body reporting fetchErr, as written by fetchError.
+func fetchErrorBody(fetchErr *fetcher.Error) (int, fiber.Map) {
+	body := fiber.Map{"code": fetchErr.Code}
+	status := fiber.StatusBadGateway
+	var message string
+
+	switch fetchErr.Code {
+	case fetcher.CodeInvalidURL:
+		status, message = fiber.StatusBadRequest, "Image URL is malformed"
+	case fetcher.CodeUnsupportedScheme:
+		status, message = fiber.StatusBadRequest, "Image URL scheme is not supported"
+	case fetcher.CodeNotFound:
+		status, message = fiber.StatusNotFound, "Image not found"
+	case fetcher.CodeForbiddenAddress:
+		status, message = fiber.StatusBadRequest, "Image URL points to a forbidden address"
+	case fetcher.CodeUpstreamStatus:
+		var statusErr *fetcher.StatusError
+		errors.As(fetchErr, &statusErr)
+		message = fmt.Sprintf("Image host answered with status %d", statusErr.Code)
+		body["upstream_status"] = statusErr.Code
+	case fetcher.CodeTimeout:
+		status, message = fiber.StatusGatewayTimeout, "Image host did not answer in time"
+	case fetcher.CodeHostNotAllowed:
+		status, message = fiber.StatusForbidden, "Images from this host are not allowed"
+	case fetcher.CodeTooLarge:
+		var sizeErr *fetcher.SizeError
+		errors.As(fetchErr, &sizeErr)
+		status, message = fiber.StatusRequestEntityTooLarge, fmt.Sprintf("Image exceeds the maximum size of %d bytes", sizeErr.Limit)
+	case fetcher.CodeUnsupportedType:
+		status, message = fiber.StatusUnsupportedMediaType, "Image URL does not point to an image"
+	default:
+		message = "Failed to fetch image"
+	}
+
+	body["error"] = message
+	return status, body
+}
+
+// processingError writes the JSON response for a request whose image could not be
+// processed: 503 with code "server_busy" and a Retry-After header when the server has
+// no capacity left for it (see admission.Limiter), and, when its context ended first,
+// 504 with code "processing_timeout" when its deadline passed or 503 with code
+// "cancelled" when it was cancelled. Other errors are returned unchanged, for the Fiber
+// error handler.
+func processingError(c *fiber.Ctx, err error) error {
+	status, body, ok := processingErrorBody(err)
+	if !ok {
+		return err
+	}
+
+	if errors.Is(err, admission.ErrBusy) {
+		// Suggest waiting about as long as a request may queue.
+		wait := c.Locals("limiter").(*admission.Limiter).MaxWait()
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+	}
+	return c.Status(status).JSON(body)
+}
+
+// processingErrorBody returns the status and JSON body reporting err, as written by
+// processingError, and false for the errors processingError returns unchanged.
+func processingErrorBody(err error) (int, fiber.Map, bool) {
+	switch {
+	case errors.Is(err, admission.ErrBusy):
+		return fiber.StatusServiceUnavailable, fiber.Map{
+			"error": "Server is busy filtering other images, retry later",
+			"code":  "server_busy",
+		}, true
+	case errors.Is(err, context.DeadlineExceeded):
+		return fiber.StatusGatewayTimeout, fiber.Map{
+			"error": "Processing the image took too long",
+			"code":  "processing_timeout",
+		}, true
+	case errors.Is(err, context.Canceled):
+		return fiber.StatusServiceUnavailable, fiber.Map{
+			"error": "Request was cancelled before the image was processed",
+			"code":  "cancelled",
+		}, true
+	}
+	return 0, nil, false
+}
+
+// requestSeed returns the seed given by the "seed" query parameter, or a random one
+// when the parameter is omitted, keeping random filters random by default.
+func requestSeed(c *fiber.Ctx) (int64, error) {
+	value := c.Query("seed")
+	if value == "" {
+		return rand.Int63(), nil
+	}
+
+	seed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for parameter 'seed': must be a 64-bit integer", value)
+	}
+	return seed, nil
+}
+
+// pipelineError writes the JSON response for an error returned while resolving filters
+// or their parameters: 404 with suggestions for an unknown filter, 400 naming the parameter
+// for an invalid parameter, and a plain 400 for any other malformed pipeline.
+func pipelineError(c *fiber.Ctx, err error) error {
+	status, body, ok := pipelineErrorBody(err)
+	if !ok {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return c.Status(status).JSON(body)
+}
+
+// pipelineErrorBody returns the status and JSON body reporting err, as written by
+// pipelineError, and false for the malformed pipelines reported with a plain 400.
+func pipelineErrorBody(err error) (int, fiber.Map, bool) {
+	var unknownErr *filters.UnknownFilterError
+	if errors.As(err, &unknownErr) {
+		return fiber.StatusNotFound, fiber.Map{
+			"error":       fmt.Sprintf("Unknown filter '%s'", unknownErr.Name),
+			"suggestions": unknownErr.Suggestions,
+		}, true
+	}
+
+	var paramErr *filters.ParamError
+	if errors.As(err, &paramErr) {
+		return fiber.StatusBadRequest, fiber.Map{
+			"error":  err.Error(),
+			"filter": paramErr.Filter,
+			"param":  paramErr.Param,
+		}, true
+	}
+
+	return 0, nil, false
+}
+
+// examplesDir is the directory holding the sample renders of every filter and
+// examplesPath is the URL prefix under which SetupRoutes serves them.
+const (
+	examplesDir  = "./example"
+	examplesPath = "/examples"
+)
+
+// listFilters handles GET /filters and returns every registered filter with its
+// description, accepted parameters and their defaults, whether its output is random,
+// and links to its sample renders when they exist in the examples directory.
+//
+// Response JSON:
+//   - count:    int, number of registered filters
+//   - original: object, links to the unfiltered sample images
+//   - filters:  array of objects with name, path, description, random, params and examples
+func listFilters(c *fiber.Ctx) error {
+	all := filters.All()
+	list := make([]fiber.Map, 0, len(all))
+
+	for _, f := range all {
+		params := f.Params()
+		if params == nil {
+			params = []filters.Param{}
+		}
+
+		list = append(list, fiber.Map{
+			"name":        f.Name(),
+			"path":        "/api/v4/filters/" + f.Name(),
+			"description": f.Description(),
+			"random":      f.Random(),
+			"params":      params,
+			"examples":    exampleLinks(f.Name()),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"count":    len(list),
+		"original": exampleLinks("original"),
+		"filters":  list,
 	})
 }
 
-// fetchImage retrieves the content of the image from the specified URL.
-// It performs an HTTP GET request and returns the image data as a byte slice.
-// If the request fails or the response status is not 200 OK, it returns an error.
-func fetchImage(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+// exampleLinks returns the public links to the sample renders named after name,
+// keyed by image format. Formats without a sample file are omitted.
+func exampleLinks(name string) fiber.Map {
+	links := fiber.Map{}
+	for _, ext := range []string{"jpeg", "gif"} {
+		file := name + "." + ext
+		if _, err := os.Stat(filepath.Join(examplesDir, file)); err == nil {
+			links[ext] = examplesPath + "/" + file
+		}
+	}
+	return links
+}
+
+// requestImage returns the bytes of the image to filter: the image referenced by the "image"
+// query parameter, which is loaded by the source registered for its scheme (http, https, asset,
+// data and, when enabled, file), or else the upload of a POST request (see uploadedImage).
+// Loading failures are returned as *fetcher.Error, to be reported with fetchError.
+func requestImage(c *fiber.Ctx) ([]byte, error) {
+	if c.Method() == fiber.MethodPost && c.Query("image") == "" {
+		return uploadedImage(c)
+	}
+
+	imageURL := c.Query("image")
+	if imageURL == "" {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Image URL is required")
+	}
+
+	return c.Locals("sources").(*fetcher.Sources).Load(c.UserContext(), imageURL)
+}
+
+// uploadedImage returns the image uploaded in the request body. A multipart/form-data
+// request must carry the image in its "image" field; any other request body is taken
+// as the raw image. Images larger than the configured maximum upload size are rejected
+// with 413 Request Entity Too Large, and compressed bodies with 415 (see rawBody).
+//
+// The returned bytes are a copy, which the rendering may keep using once the handler has
+// returned, when it is shared with other requests.
+func uploadedImage(c *fiber.Ctx) ([]byte, error) {
+	maxSize := c.Locals("config").(*config.Config).Filters.MaxUploadSize
+	tooLarge := fiber.NewError(fiber.StatusRequestEntityTooLarge,
+		fmt.Sprintf("Image exceeds the maximum upload size of %d bytes", maxSize))
+
+	body, err := rawBody(c)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("failed to fetch image, status %d", resp.StatusCode)
+
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		if len(body) == 0 {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Request body must contain an image")
+		}
+		if int64(len(body)) > maxSize {
+			return nil, tooLarge
+		}
+		return bytes.Clone(body), nil
+	}
+
+	header, err := c.FormFile("image")
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Multipart form must contain an 'image' file field")
+	}
+	if header.Size > maxSize {
+		return nil, tooLarge
 	}
-	return io.ReadAll(resp.Body)
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Failed to read uploaded image")
+	}
+	defer file.Close()
+
+	return io.ReadAll(io.LimitReader(file, maxSize))
 }
 
-// handleGIF processes a GIF image using the specified filter and writes the filtered GIF to the response.
-// It decodes the input GIF data, applies the filter via services.ProcessGIF, and encodes the result back to the client.
-// Returns a Fiber error if decoding or processing fails.
+// rawBody returns the request body as received. Compressed bodies are refused with
+// 415 Unsupported Media Type: Fiber would inflate them in memory, with no bound, before
+// their size could be checked, and images gain nothing from being compressed again.
+func rawBody(c *fiber.Ctx) ([]byte, error) {
+	if encoding := c.Get(fiber.HeaderContentEncoding); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return nil, fiber.NewError(fiber.StatusUnsupportedMediaType, "Compressed request bodies are not supported")
+	}
+	return c.Request().Body(), nil
+}
+
+// renderGIF processes a GIF image using the specified filter pipeline and returns the filtered GIF.
+// It decodes the input GIF data, applies the filter via services.ProcessGIF, and encodes the result back.
+// Returns a Fiber error if decoding or processing fails, and ctx.Err() once ctx is done.
 //
 // Parameters:
-//   - c: Fiber context for the HTTP request and response.
-//   - filter: The name of the filter to apply to the GIF.
+//   - ctx: Cancels the processing of the frames.
+//   - pipeline: The filter steps to apply to every frame of the GIF.
 //   - data: The raw GIF image data as a byte slice.
+//   - seed: The seed of the random source used by random filters.
+//   - opts: The palette, dithering and worker count used to process the frames.
 //
 // Returns:
+//   - []byte: The encoded filtered GIF.
 //   - error: An error if the GIF cannot be decoded, processed, or encoded; otherwise, nil.
-func handleGIF(c *fiber.Ctx, filter string, data []byte) error {
+func renderGIF(ctx context.Context, pipeline filters.Pipeline, data []byte, seed int64, opts services.GIFOptions) ([]byte, error) {
 	gifReader := bytes.NewReader(data)
 	gifData, err := gif.DecodeAll(gifReader)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Failed to decode GIF fully")
+		return nil, decodeError(err)
+	}
+	defer services.ReleaseGIF(gifData)
+	filteredGIF, err := services.ProcessGIF(ctx, pipeline, gifData, seed, opts)
+	if ctxErr := ctx.Err(); ctxErr != nil && err != nil {
+		return nil, ctxErr
 	}
-	filteredGIF, err := services.ProcessGIF(filter, gifData)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Failed to process GIF")
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to process GIF")
+	}
+	defer services.ReleaseGIF(filteredGIF)
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, filteredGIF); err != nil {
+		return nil, err
 	}
-	c.Set("Content-Type", "image/gif")
-	return gif.EncodeAll(c.Context().Response.BodyWriter(), filteredGIF)
+	return buf.Bytes(), nil
 }
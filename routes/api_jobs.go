@@ -0,0 +1,207 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"neko-love/filters"
+	"neko-love/services"
+	"neko-love/services/admission"
+	"neko-love/services/jobs"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RegisterJobRoutes registers the asynchronous filter job routes to the provided Fiber router.
+// Jobs apply a filter pipeline to an image like "/filters/chain", for animations too long to
+// filter within an HTTP request. A job is submitted with POST "/jobs", which validates the
+// request as the filter endpoints do, then answers 202 Accepted at once with the job; the job
+// is processed in the background by the jobs.Manager available in the context locals as "jobs",
+// once admitted by the admission.Limiter of the filter endpoints (see renderWhenAdmitted).
+// GET "/jobs/:id" reports its status and progress, counted in frames, and GET "/jobs/:id/result"
+// returns the filtered image once it is done. Jobs are forgotten, result included, once their
+// configured TTL has elapsed after they complete.
+//
+// Routes:
+//
+//	POST /jobs?steps=<filter>[:<param>=<value>...][,<filter>...][&image=<image_url>]
+//	GET  /jobs/:id
+//	GET  /jobs/:id/result
+//
+// Parameters:
+//   - steps: The comma-separated filter pipeline, e.g. deepfry,pixelate:block=10,glitch (query parameter).
+//   - image: The URL of the image to process (query parameter), or else the uploaded image
+//     (raw body or multipart form field).
+//   - seed, format, quality, palette, dither: As for the filter endpoints (query parameters).
+//   - id: The ID of the job, as returned on submission (path parameter).
+func RegisterJobRoutes(router fiber.Router) {
+	router.Post("/jobs", submitJob)
+	router.Get("/jobs/:id", getJob)
+	router.Get("/jobs/:id/result", getJobResult)
+}
+
+// jobOutput describes the result of a filter job, for the response serving it.
+type jobOutput struct {
+	seed int64
+	opts services.OutputOptions
+}
+
+// submitJob handles POST /jobs. Invalid requests get the same errors as the filter endpoints;
+// when the job queue is full, the response is 503 with code "server_busy".
+func submitJob(c *fiber.Ctx) error {
+	// The deadline of the request bounds loading the image; the job has its own.
+	cancel := applyTimeout(c)
+	defer cancel()
+
+	pipeline, err := filters.ParsePipeline(c.Query("steps"))
+	if err != nil {
+		return pipelineError(c, err)
+	}
+
+	req, err := parseRenderRequest(c, pipeline)
+	if req == nil {
+		return err
+	}
+
+	output := jobOutput{seed: req.seed, opts: req.opts}
+	render := admittedRender(c.Locals("limiter").(*admission.Limiter), req)
+	job, err := c.Locals("jobs").(*jobs.Manager).Submit(req.frames, output, func(ctx context.Context, advance func()) ([]byte, error) {
+		req.opts.GIF.Progress = advance
+		return renderWhenAdmitted(ctx, render)
+	})
+	if errors.Is(err, jobs.ErrQueueFull) {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Too many jobs are waiting, retry later",
+			"code":  "server_busy",
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	c.Locals("noCache", true)
+	c.Location(jobPath(job.ID))
+	return c.Status(fiber.StatusAccepted).JSON(jobStatus(job.Snapshot()))
+}
+
+// jobAdmissionRetry is how long a job refused by the admission.Limiter waits before
+// asking again.
+const jobAdmissionRetry = time.Second
+
+// renderWhenAdmitted runs render, an admittedRender, until the limiter admits it. Jobs share
+// the capacity of the filter endpoints, but unlike requests they are not refused when the
+// server is busy: they queue again, within their own timeout, while requests keep their turn.
+func renderWhenAdmitted(ctx context.Context, render func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	for {
+		body, err := render(ctx)
+		if !errors.Is(err, admission.ErrBusy) {
+			return body, err
+		}
+		select {
+		case <-time.After(jobAdmissionRetry):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// getJob handles GET /jobs/:id, returning the status of the job (see jobStatus), or 404
+// with code "job_not_found" when it does not exist or has expired.
+func getJob(c *fiber.Ctx) error {
+	job, ok := c.Locals("jobs").(*jobs.Manager).Get(c.Params("id"))
+	if !ok {
+		return jobNotFound(c)
+	}
+
+	c.Locals("noCache", true)
+	return c.JSON(jobStatus(job.Snapshot()))
+}
+
+// getJobResult handles GET /jobs/:id/result, returning the filtered image of a done job with
+// the headers of the filter endpoints. It answers 404 with code "job_not_found" when the job
+// does not exist or has expired, and 409 with code "job_not_done", along with its status,
+// while it is queued or running and when it failed.
+func getJobResult(c *fiber.Ctx) error {
+	job, ok := c.Locals("jobs").(*jobs.Manager).Get(c.Params("id"))
+	if !ok {
+		return jobNotFound(c)
+	}
+
+	body, done := job.Result()
+	if !done && job.Snapshot().Status == jobs.Done {
+		// The job was forgotten since it was looked up.
+		return jobNotFound(c)
+	}
+	if !done {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":  "Job has no result",
+			"code":   "job_not_done",
+			"status": job.Snapshot().Status,
+		})
+	}
+
+	output := job.Info.(jobOutput)
+	c.Set("X-Filter-Seed", strconv.FormatInt(output.seed, 10))
+	services.SetOutputHeaders(c, output.opts)
+	return c.Send(body)
+}
+
+// jobNotFound writes the response for an unknown or expired job.
+func jobNotFound(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+		"error": "Job not found or expired",
+		"code":  "job_not_found",
+	})
+}
+
+// jobStatus returns the JSON description of a job:
+//   - id, status: the ID of the job and one of queued, running, done or failed;
+//   - frames_done, frames_total: the progress of the job, counted in frames;
+//   - created_at and, once the job completes, expires_at: RFC 3339 times;
+//   - result: the path of the result of a done job;
+//   - error, code: why a failed job failed (see jobFailure).
+func jobStatus(s jobs.Snapshot) fiber.Map {
+	body := fiber.Map{
+		"id":           s.ID,
+		"status":       s.Status,
+		"frames_done":  s.Done,
+		"frames_total": s.Total,
+		"created_at":   s.Created.UTC().Format(time.RFC3339),
+	}
+	if !s.Expires.IsZero() {
+		body["expires_at"] = s.Expires.UTC().Format(time.RFC3339)
+	}
+
+	switch s.Status {
+	case jobs.Done:
+		body["result"] = jobPath(s.ID) + "/result"
+	case jobs.Failed:
+		body["code"], body["error"] = jobFailure(s.Err)
+	}
+	return body
+}
+
+// jobFailure returns the code and message reporting the error of a failed job:
+// "processing_timeout" when it ran out of time, "result_too_large" when its result
+// exceeds the size kept for results, and "processing_failed" otherwise.
+func jobFailure(err error) (code, message string) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "processing_timeout", "Processing the image took too long"
+	}
+	if errors.Is(err, jobs.ErrResultTooLarge) {
+		return "result_too_large", "Filtered image is too large to be kept"
+	}
+
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return "processing_failed", fiberErr.Message
+	}
+	return "processing_failed", "Failed to process image"
+}
+
+// jobPath returns the path of the job with the given ID.
+func jobPath(id string) string {
+	return "/api/v4/jobs/" + id
+}
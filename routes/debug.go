@@ -1,7 +1,9 @@
 package routes
 
 import (
+	"neko-love/services/admission"
 	"neko-love/services/cache"
+	"neko-love/services/fetcher"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -10,6 +12,11 @@ import (
 // Specifically, it adds a GET endpoint at "/cache/:category" that returns a JSON
 // response containing the list of cached files for the specified category.
 // The cache is expected to be available in the context locals as "cacheAssets".
+// It also adds a GET endpoint at "/fetch/cache" that reports the size of the cache of
+// downloaded images and its hit, revalidation and miss counts, read from the Fetcher
+// available in the context locals as "fetcher", and a GET endpoint at "/admission" that
+// reports the filter work running and queued, read from the admission.Limiter available
+// in the context locals as "limiter".
 func RegisterDebugRoutes(router fiber.Router) {
 	router.Get("/cache/:category", func(c *fiber.Ctx) error {
 		category := c.Params("category")
@@ -20,4 +27,12 @@ func RegisterDebugRoutes(router fiber.Router) {
 			"files":    files,
 		})
 	})
+
+	router.Get("/fetch/cache", func(c *fiber.Ctx) error {
+		return c.JSON(c.Locals("fetcher").(*fetcher.Fetcher).CacheStats())
+	})
+
+	router.Get("/admission", func(c *fiber.Ctx) error {
+		return c.JSON(c.Locals("limiter").(*admission.Limiter).Stats())
+	})
 }
@@ -0,0 +1,82 @@
+package routes
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// disconnectPollInterval is how often the connection of a request being processed is
+// checked for the client having closed it.
+const disconnectPollInterval = 100 * time.Millisecond
+
+// watchDisconnect cancels the context of the request as soon as the client closes its
+// connection, so filtering stops for a response nobody will read. fasthttp does not read
+// from a connection while its handler runs, so the connection is peeked at periodically,
+// without consuming anything from it. Connections that do not expose their socket, such
+// as TLS ones, are not watched. The returned function stops watching; it must be called
+// before the handler returns.
+func watchDisconnect(c *fiber.Ctx) func() {
+	raw := socketOf(c)
+	if raw == nil {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(c.UserContext())
+	c.SetUserContext(ctx)
+	stop := watchSocket(ctx, cancel, raw)
+	return func() {
+		stop()
+		cancel()
+	}
+}
+
+// socketOf returns the socket of the connection of c, or nil when the connection does not
+// expose it. It stays usable after the handler returns, for the body stream writers of
+// fasthttp, which run while the connection is still being served.
+func socketOf(c *fiber.Ctx) syscall.RawConn {
+	conn, ok := c.Context().Conn().(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+// watchSocket calls cancel as soon as the peer of raw closes the connection, until ctx is
+// done or the returned function is called. That function returns once raw is no longer
+// peeked at, since fasthttp reads the next request from the connection afterwards.
+func watchSocket(ctx context.Context, cancel context.CancelFunc, raw syscall.RawConn) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(disconnectPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if peerClosed(raw) {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
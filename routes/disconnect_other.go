@@ -0,0 +1,11 @@
+//go:build !unix
+
+package routes
+
+import "syscall"
+
+// peerClosed reports whether the peer of the socket has closed the connection. Sockets
+// cannot be peeked at portably: disconnects are only detected on Unix systems.
+func peerClosed(syscall.RawConn) bool {
+	return false
+}
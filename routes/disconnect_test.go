@@ -0,0 +1,102 @@
+//go:build unix
+
+package routes
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestPeerClosed checks that peerClosed tells a client that closed its connection from
+// one that is idle or has sent more data, without consuming that data.
+func TestPeerClosed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	raw, err := server.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peerClosed(raw) {
+		t.Fatal("idle connection reported as closed")
+	}
+	if _, err := client.Write([]byte("GET")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if peerClosed(raw) {
+		t.Fatal("connection with pending data reported as closed")
+	}
+	buf := make([]byte, 8)
+	if n, err := server.Read(buf); err != nil || string(buf[:n]) != "GET" {
+		t.Fatalf("pending data was consumed: read %q, %v", buf[:n], err)
+	}
+
+	client.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for !peerClosed(raw) {
+		if time.Now().After(deadline) {
+			t.Fatal("closed connection not detected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestWatchSocket checks that watchSocket cancels its context once the client closes its
+// connection, and only then.
+func TestWatchSocket(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	raw, err := server.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := watchSocket(ctx, cancel, raw)
+	defer stop()
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("cancelled while the client is connected")
+	case <-time.After(3 * disconnectPollInterval):
+	}
+
+	client.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("not cancelled once the client closed its connection")
+	}
+}
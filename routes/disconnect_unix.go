@@ -0,0 +1,26 @@
+//go:build unix
+
+package routes
+
+import "syscall"
+
+// peerClosed reports whether the peer of the socket has closed or reset the connection.
+// It peeks at the data waiting on the socket without blocking or consuming it: a read
+// of zero bytes is the end of the stream, while pending data, such as the next request
+// of a keep-alive connection, means the client is still there.
+func peerClosed(raw syscall.RawConn) bool {
+	var closed bool
+	var buf [1]byte
+	err := raw.Read(func(fd uintptr) bool {
+		n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK)
+		switch err {
+		case nil:
+			closed = n == 0
+		case syscall.EAGAIN, syscall.EINTR:
+		default:
+			closed = true
+		}
+		return true
+	})
+	return closed || err != nil
+}
@@ -8,16 +8,21 @@ import (
 
 // SetupRoutes configures the main application routes for the Fiber app.
 // It applies middleware to disable caching, sets up API version 4 routes for images and filters,
-// and registers debug routes under the "/debug" path.
+// serves the filter sample renders under "/examples", and registers debug routes under the "/debug" path.
+// Filter and job routes are registered before image routes so "/api/v4/filters" and "/api/v4/jobs"
+// are not taken for a category.
 //
 // Parameters:
 //   - app: The Fiber application instance to which the routes will be attached.
 func SetupRoutes(app *fiber.App) {
 	app.Use(middlewares.NoCache())
 
+	app.Static(examplesPath, examplesDir)
+
 	api := app.Group("/api/v4")
-	RegisterImageRoutes(api)
 	RegisterFilterRoutes(api)
+	RegisterJobRoutes(api)
+	RegisterImageRoutes(api)
 
 	debug := app.Group("/debug")
 	RegisterDebugRoutes(debug)
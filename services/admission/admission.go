@@ -0,0 +1,157 @@
+package admission
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBusy is returned by Limiter.Acquire when the work cannot be admitted: the wait
+// queue is full, or the work waited for longer than the limiter allows.
+var ErrBusy = errors.New("admission: too much work in progress")
+
+// Stats reports the activity of a Limiter.
+type Stats struct {
+	// Capacity is the total weight of the work allowed at once and InUse the weight
+	// of the work running.
+	Capacity int64 `json:"capacity"`
+	InUse    int64 `json:"in_use"`
+	// Queued is the number of callers waiting for capacity, out of at most MaxQueue.
+	Queued   int `json:"queued"`
+	MaxQueue int `json:"max_queue"`
+	// Admitted counts the work admitted and Rejected the work refused with ErrBusy.
+	Admitted int64 `json:"admitted"`
+	Rejected int64 `json:"rejected"`
+}
+
+// Limiter is a weighted semaphore bounding the CPU-heavy work running at once, so a
+// burst of expensive requests cannot starve the rest of the server. Each piece of work
+// declares a weight; work that does not fit waits in a bounded first-in first-out queue
+// for a bounded time, and is refused beyond that, shedding the load instead of letting
+// it pile up.
+type Limiter struct {
+	capacity int64
+	maxQueue int
+	maxWait  time.Duration
+
+	mu      sync.Mutex
+	inUse   int64
+	waiters list.List // of *waiter, first come first
+
+	admitted, rejected atomic.Int64
+}
+
+// waiter is a caller queued in a Limiter, whose ready channel is closed once its
+// weight has been granted.
+type waiter struct {
+	weight int64
+	ready  chan struct{}
+}
+
+// New returns a limiter running work up to a total weight of capacity, with up to
+// maxQueue callers waiting at most maxWait for their turn. A capacity below 1 is
+// taken as 1.
+func New(capacity int64, maxQueue int, maxWait time.Duration) *Limiter {
+	return &Limiter{capacity: max(capacity, 1), maxQueue: maxQueue, maxWait: maxWait}
+}
+
+// Acquire waits until work of the given weight can run and returns the function to
+// call once it is done. Weights are clamped to [1, capacity], so work heavier than
+// the whole capacity still runs, alone. It returns ErrBusy when the queue is full or
+// the wait exceeds the maximum of the limiter, and ctx.Err() when ctx is done first.
+func (l *Limiter) Acquire(ctx context.Context, weight int64) (release func(), err error) {
+	weight = min(max(weight, 1), l.capacity)
+	release = func() { l.release(weight) }
+
+	l.mu.Lock()
+	// Work only skips the queue when nobody is waiting, so heavy work is not starved
+	// by a stream of light work.
+	if l.waiters.Len() == 0 && l.inUse+weight <= l.capacity {
+		l.inUse += weight
+		l.mu.Unlock()
+		l.admitted.Add(1)
+		return release, nil
+	}
+	if l.waiters.Len() >= l.maxQueue {
+		l.mu.Unlock()
+		l.rejected.Add(1)
+		return nil, ErrBusy
+	}
+	w := &waiter{weight: weight, ready: make(chan struct{})}
+	elem := l.waiters.PushBack(w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		l.admitted.Add(1)
+		return release, nil
+	case <-timer.C:
+		err = ErrBusy
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	select {
+	case <-w.ready:
+		// Granted while giving up: hand the weight back.
+		l.inUse -= weight
+	default:
+		l.waiters.Remove(elem)
+	}
+	l.grant()
+	l.mu.Unlock()
+
+	if err == ErrBusy {
+		l.rejected.Add(1)
+	}
+	return nil, err
+}
+
+// release hands back the weight of finished work and admits the waiters it makes room for.
+func (l *Limiter) release(weight int64) {
+	l.mu.Lock()
+	l.inUse -= weight
+	l.grant()
+	l.mu.Unlock()
+}
+
+// grant admits the waiters at the front of the queue, in order, while they fit.
+// l.mu must be held.
+func (l *Limiter) grant() {
+	for elem := l.waiters.Front(); elem != nil; elem = l.waiters.Front() {
+		w := elem.Value.(*waiter)
+		if l.inUse+w.weight > l.capacity {
+			return
+		}
+		l.inUse += w.weight
+		l.waiters.Remove(elem)
+		close(w.ready)
+	}
+}
+
+// MaxWait returns the longest time a caller waits in the queue.
+func (l *Limiter) MaxWait() time.Duration {
+	return l.maxWait
+}
+
+// Stats returns the current statistics of the limiter.
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return Stats{
+		Capacity: l.capacity,
+		InUse:    l.inUse,
+		Queued:   l.waiters.Len(),
+		MaxQueue: l.maxQueue,
+		Admitted: l.admitted.Load(),
+		Rejected: l.rejected.Load(),
+	}
+}
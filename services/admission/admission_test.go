@@ -0,0 +1,250 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type acquired struct {
+	release func()
+	err     error
+}
+
+// acquire calls l.Acquire in a new goroutine and returns a channel receiving its result.
+func acquire(ctx context.Context, l *Limiter, weight int64) <-chan acquired {
+	ch := make(chan acquired, 1)
+	go func() {
+		release, err := l.Acquire(ctx, weight)
+		ch <- acquired{release, err}
+	}()
+	return ch
+}
+
+// mustAcquire acquires weight from l at once.
+func mustAcquire(t *testing.T, l *Limiter, weight int64) func() {
+	t.Helper()
+	release, err := l.Acquire(context.Background(), weight)
+	if err != nil {
+		t.Fatalf("acquiring %d: %v", weight, err)
+	}
+	return release
+}
+
+// waitQueued waits until n callers are queued in l.
+func waitQueued(t *testing.T, l *Limiter, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for l.Stats().Queued != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callers queued, want %d", l.Stats().Queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// granted returns the release function of a queued caller once it is admitted.
+func granted(t *testing.T, ch <-chan acquired) func() {
+	t.Helper()
+	select {
+	case a := <-ch:
+		if a.err != nil {
+			t.Fatalf("got %v, want the weight granted", a.err)
+		}
+		return a.release
+	case <-time.After(5 * time.Second):
+		t.Fatal("the weight was not granted")
+		return nil
+	}
+}
+
+// notGranted checks that a queued caller is still waiting.
+func notGranted(t *testing.T, ch <-chan acquired) {
+	t.Helper()
+	select {
+	case a := <-ch:
+		t.Fatalf("got %v, want the caller still queued", a.err)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// checkStats compares the statistics of l with want, ignoring the fixed settings.
+func checkStats(t *testing.T, l *Limiter, want Stats) {
+	t.Helper()
+	got := l.Stats()
+	want.Capacity, want.MaxQueue = got.Capacity, got.MaxQueue
+	if got != want {
+		t.Fatalf("got stats %+v, want %+v", got, want)
+	}
+}
+
+// TestBusy checks that work waiting for longer than the maximum wait is refused.
+func TestBusy(t *testing.T) {
+	const maxWait = 30 * time.Millisecond
+	l := New(1, 4, maxWait)
+	release := mustAcquire(t, l, 1)
+
+	start := time.Now()
+	if _, err := l.Acquire(context.Background(), 1); !errors.Is(err, ErrBusy) {
+		t.Fatalf("got %v, want ErrBusy", err)
+	}
+	if waited := time.Since(start); waited < maxWait {
+		t.Fatalf("refused after %v, want at least %v", waited, maxWait)
+	}
+	checkStats(t, l, Stats{InUse: 1, Admitted: 1, Rejected: 1})
+
+	release()
+	mustAcquire(t, l, 1)()
+	checkStats(t, l, Stats{Admitted: 2, Rejected: 1})
+}
+
+// TestQueueLimit checks that work arriving while the queue is full is refused at once,
+// and that the queued work is admitted in order.
+func TestQueueLimit(t *testing.T) {
+	l := New(1, 2, time.Hour)
+	release := mustAcquire(t, l, 1)
+	first := acquire(context.Background(), l, 1)
+	waitQueued(t, l, 1)
+	second := acquire(context.Background(), l, 1)
+	waitQueued(t, l, 2)
+
+	start := time.Now()
+	if _, err := l.Acquire(context.Background(), 1); !errors.Is(err, ErrBusy) {
+		t.Fatalf("got %v, want ErrBusy", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("refused after %v, want at once", waited)
+	}
+	checkStats(t, l, Stats{InUse: 1, Queued: 2, Admitted: 1, Rejected: 1})
+
+	release()
+	release = granted(t, first)
+	notGranted(t, second)
+	release()
+	granted(t, second)()
+	checkStats(t, l, Stats{Admitted: 3, Rejected: 1})
+}
+
+// TestHeavyNotStarved checks that light work does not skip ahead of queued heavy work,
+// even when it would fit, and that work heavier than the capacity runs alone.
+func TestHeavyNotStarved(t *testing.T) {
+	l := New(4, 8, time.Hour)
+	light := mustAcquire(t, l, 1)
+
+	heavy := acquire(context.Background(), l, 10)
+	waitQueued(t, l, 1)
+	next := acquire(context.Background(), l, 1)
+	waitQueued(t, l, 2)
+	notGranted(t, next)
+	checkStats(t, l, Stats{InUse: 1, Queued: 2, Admitted: 1})
+
+	light()
+	release := granted(t, heavy)
+	checkStats(t, l, Stats{InUse: 4, Queued: 1, Admitted: 2})
+	notGranted(t, next)
+
+	release()
+	granted(t, next)()
+	checkStats(t, l, Stats{Admitted: 3})
+}
+
+// TestHandOff checks that released weight is granted to the front of the queue only
+// once it fits, and to every waiter it then fits.
+func TestHandOff(t *testing.T) {
+	l := New(3, 8, time.Hour)
+	two := mustAcquire(t, l, 2)
+	one := mustAcquire(t, l, 1)
+
+	first := acquire(context.Background(), l, 2)
+	waitQueued(t, l, 1)
+	second := acquire(context.Background(), l, 1)
+	waitQueued(t, l, 2)
+
+	// 1 is free: enough for the second waiter, but not for the first one.
+	one()
+	notGranted(t, first)
+	notGranted(t, second)
+	checkStats(t, l, Stats{InUse: 2, Queued: 2, Admitted: 2})
+
+	two()
+	releaseFirst := granted(t, first)
+	releaseSecond := granted(t, second)
+	checkStats(t, l, Stats{InUse: 3, Admitted: 4})
+
+	releaseFirst()
+	releaseSecond()
+	checkStats(t, l, Stats{Admitted: 4})
+}
+
+// TestCancelQueued checks that a caller cancelled while queued leaves the queue without
+// being counted as rejected, and lets the waiters behind it through when they fit.
+func TestCancelQueued(t *testing.T) {
+	l := New(2, 8, time.Hour)
+	release := mustAcquire(t, l, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	heavy := acquire(ctx, l, 2)
+	waitQueued(t, l, 1)
+	light := acquire(context.Background(), l, 1)
+	waitQueued(t, l, 2)
+	notGranted(t, light)
+
+	cancel()
+	if a := <-heavy; !errors.Is(a.err, context.Canceled) || a.release != nil {
+		t.Fatalf("got %v, want context.Canceled", a.err)
+	}
+	releaseLight := granted(t, light)
+	checkStats(t, l, Stats{InUse: 2, Admitted: 2})
+
+	// A caller cancelled before its turn comes leaves everything as it was.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancelled := acquire(ctx, l, 1)
+	waitQueued(t, l, 1)
+	cancel()
+	if a := <-cancelled; !errors.Is(a.err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", a.err)
+	}
+	checkStats(t, l, Stats{InUse: 2, Admitted: 2})
+
+	release()
+	releaseLight()
+	checkStats(t, l, Stats{Admitted: 2})
+	mustAcquire(t, l, 2)()
+	checkStats(t, l, Stats{Admitted: 3})
+}
+
+// TestCancelRace checks that the weight stays accounted for when callers give up around
+// the time it is granted to them.
+func TestCancelRace(t *testing.T) {
+	l := New(2, 64, time.Hour)
+	for i := range 200 {
+		release := mustAcquire(t, l, 2)
+		ctx, cancel := context.WithCancel(context.Background())
+		waiting := []<-chan acquired{acquire(ctx, l, 1), acquire(ctx, l, 1)}
+		waitQueued(t, l, 2)
+
+		// Release and cancel at once, in either order.
+		done := make(chan struct{})
+		first, second := release, func() { cancel() }
+		if i%2 == 1 {
+			first, second = second, first
+		}
+		go func() {
+			first()
+			close(done)
+		}()
+		second()
+		<-done
+		for _, ch := range waiting {
+			if a := <-ch; a.err == nil {
+				a.release()
+			} else if !errors.Is(a.err, context.Canceled) {
+				t.Fatalf("got %v, want context.Canceled", a.err)
+			}
+		}
+		if s := l.Stats(); s.InUse != 0 || s.Queued != 0 || s.Rejected != 0 {
+			t.Fatalf("round %d: got stats %+v, want nothing in use or queued", i, s)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"image"
+	"image/draw"
+	"image/gif"
+	"neko-love/filters"
+)
+
+// compositor rebuilds the frames of a GIF as full logical-screen images, the way a
+// viewer displays them, one at a time and in order. Each frame is drawn over the canvas
+// left by the previous one, which lets optimised GIFs store only the sub-rectangle that
+// changed. After a frame is captured, its disposal method is applied to the canvas:
+//   - DisposalNone (and unspecified): the frame stays on the canvas.
+//   - DisposalBackground: the frame rectangle is cleared to transparent.
+//   - DisposalPrevious: the canvas is restored to its state before the frame was drawn.
+type compositor struct {
+	g      *gif.GIF
+	canvas *image.RGBA
+	// saved is the canvas before the last frame disposed with DisposalPrevious.
+	saved *image.RGBA
+	next  int
+}
+
+// newCompositor returns a compositor for the frames of g, whose buffers must be handed
+// back with release once it is done.
+func newCompositor(g *gif.GIF) *compositor {
+	return &compositor{g: g, canvas: filters.NewRGBA(logicalScreen(g))}
+}
+
+// frame returns the composited frame at index i, a copy of the canvas in a pooled buffer
+// owned by the caller. Frames must be asked for in order, each once.
+func (c *compositor) frame(i int) *image.RGBA {
+	if i != c.next {
+		panic("services: GIF frames composited out of order")
+	}
+	c.next++
+
+	frame := c.g.Image[i]
+	disposal := byte(gif.DisposalNone)
+	if i < len(c.g.Disposal) {
+		disposal = c.g.Disposal[i]
+	}
+
+	if disposal == gif.DisposalPrevious {
+		filters.ReleaseRGBA(c.saved)
+		c.saved = cloneRGBA(c.canvas)
+	}
+
+	draw.Draw(c.canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	composited := cloneRGBA(c.canvas)
+
+	switch disposal {
+	case gif.DisposalBackground:
+		draw.Draw(c.canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+	case gif.DisposalPrevious:
+		copy(c.canvas.Pix, c.saved.Pix)
+	}
+	return composited
+}
+
+// release hands the buffers of the compositor back to the pool.
+func (c *compositor) release() {
+	filters.ReleaseRGBA(c.canvas)
+	filters.ReleaseRGBA(c.saved)
+	c.canvas, c.saved = nil, nil
+}
+
+// logicalScreen returns the logical screen rectangle of g, taken from its Config
+// when present, or else from the union of its frame bounds.
+func logicalScreen(g *gif.GIF) image.Rectangle {
+	if g.Config.Width > 0 && g.Config.Height > 0 {
+		return image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	}
+
+	var screen image.Rectangle
+	for _, frame := range g.Image {
+		screen = screen.Union(frame.Bounds())
+	}
+	return image.Rect(0, 0, screen.Max.X, screen.Max.Y)
+}
+
+// cloneRGBA returns a copy of img, in a pooled buffer.
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	dup := filters.NewRGBA(img.Rect)
+	copy(dup.Pix, img.Pix)
+	return dup
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+
+	"neko-love/filters"
+)
+
+// testColors maps the letters used to draw test frames to their colors, '.' being
+// transparent.
+var testColors = map[byte]color.RGBA{
+	'.': {},
+	'R': {0xff, 0, 0, 0xff},
+	'G': {0, 0xff, 0, 0xff},
+	'B': {0, 0, 0xff, 0xff},
+}
+
+// testPalette holds testColors, transparent first.
+var testPalette = color.Palette{testColors['.'], testColors['R'], testColors['G'], testColors['B']}
+
+// paletted returns a frame at offset whose pixels are drawn by rows.
+func paletted(offset image.Point, rows ...string) *image.Paletted {
+	img := image.NewPaletted(image.Rectangle{Max: image.Pt(len(rows[0]), len(rows))}.Add(offset), testPalette)
+	for y, row := range rows {
+		for x := range row {
+			img.Set(offset.X+x, offset.Y+y, testColors[row[x]])
+		}
+	}
+	return img
+}
+
+// checkPixels compares the pixels of img with those drawn by rows.
+func checkPixels(t *testing.T, name string, img *image.RGBA, rows ...string) {
+	t.Helper()
+	for y, row := range rows {
+		for x := range row {
+			if got, want := img.RGBAAt(x, y), testColors[row[x]]; got != want {
+				t.Errorf("%s: pixel (%d, %d) is %v, want %v", name, x, y, got, want)
+			}
+		}
+	}
+}
+
+// TestCompositor checks the composited frames of a GIF made of offset sub-frames with
+// transparent pixels, disposed of with DisposalPrevious then DisposalBackground.
+func TestCompositor(t *testing.T) {
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			paletted(image.Pt(0, 0), "RRRR", "RRRR", "RRRR", "RRRR"),
+			paletted(image.Pt(1, 1), ".G", "GG"),
+			paletted(image.Pt(2, 0), "BB", "B."),
+		},
+		Delay:    []int{10, 10, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalPrevious, gif.DisposalBackground},
+		Config:   image.Config{ColorModel: testPalette, Width: 4, Height: 4},
+	}
+	// Go through the codec, so the frames are the ones a decoded GIF has.
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := g.Image[1].Bounds(); b != image.Rect(1, 1, 3, 3) {
+		t.Fatalf("the second frame has bounds %v once decoded", b)
+	}
+
+	c := newCompositor(g)
+	defer c.release()
+	want := [][]string{
+		{"RRRR", "RRRR", "RRRR", "RRRR"},
+		// The transparent pixel shows the first frame.
+		{"RRRR", "RRGR", "RGGR", "RRRR"},
+		// The second frame is gone, restored away by DisposalPrevious.
+		{"RRBB", "RRBR", "RRRR", "RRRR"},
+	}
+	for i, rows := range want {
+		frame := c.frame(i)
+		if frame.Rect != image.Rect(0, 0, 4, 4) {
+			t.Fatalf("frame %d has bounds %v, want the logical screen", i, frame.Rect)
+		}
+		checkPixels(t, fmt.Sprintf("frame %d", i), frame, rows...)
+		filters.ReleaseRGBA(frame)
+	}
+	// DisposalBackground clears the rectangle of the last frame to transparent.
+	checkPixels(t, "canvas", c.canvas, "RR..", "RR..", "RRRR", "RRRR")
+}
@@ -0,0 +1,230 @@
+package fetcher
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxHeuristicLifetime caps the freshness guessed from Last-Modified for responses
+// that give no explicit lifetime.
+const maxHeuristicLifetime = 24 * time.Hour
+
+// maxLifetimeSeconds caps explicit lifetimes, at about a year.
+const maxLifetimeSeconds = 365 * 24 * 60 * 60
+
+// cachedHeaders are the response headers kept with a cached image, those needed to
+// compute its freshness and to revalidate it.
+var cachedHeaders = []string{"Cache-Control", "Expires", "Date", "Age", "Last-Modified", "ETag"}
+
+// CacheStats reports the activity of the cache of downloaded images.
+type CacheStats struct {
+	// Entries is the number of images in the cache and Size their total size, in bytes.
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+	// MaxSize is the size budget of the cache, in bytes.
+	MaxSize int64 `json:"max_size"`
+	// Hits counts the images served from the cache without contacting their host.
+	Hits int64 `json:"hits"`
+	// Revalidations counts the cached images confirmed by their host with 304 Not Modified.
+	Revalidations int64 `json:"revalidations"`
+	// Misses counts the images downloaded in full.
+	Misses int64 `json:"misses"`
+}
+
+// sourceCache keeps downloaded images by URL, as a shared HTTP cache would: responses
+// are stored unless marked no-store or private, served without contacting their host
+// while they are fresh, and revalidated with a conditional request once stale. It is
+// bounded by the total size of the images, evicting the least recently used ones first.
+//
+// A nil *sourceCache is a disabled cache.
+type sourceCache struct {
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+
+	hits, revalidations, misses atomic.Int64
+}
+
+// cacheEntry is an image held by the sourceCache. Entries are never modified once
+// stored; revalidation replaces them.
+type cacheEntry struct {
+	url     string
+	data    []byte
+	header  http.Header
+	expires time.Time
+}
+
+// newSourceCache returns a cache holding up to maxSize bytes of images, or nil when
+// maxSize is not positive.
+func newSourceCache(maxSize int64) *sourceCache {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &sourceCache{maxSize: maxSize, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the entry of url, fresh or not, or nil when there is none.
+func (c *sourceCache) get(url string) *cacheEntry {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[url]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry)
+}
+
+// store caches data, downloaded from url with the response header, when the header
+// allows it. Otherwise any previous entry of url is dropped.
+func (c *sourceCache) store(url string, data []byte, header http.Header, now time.Time) {
+	if c == nil {
+		return
+	}
+
+	lifetime, storable := freshness(header, now)
+	kept := make(http.Header, len(cachedHeaders))
+	for _, name := range cachedHeaders {
+		if value := header.Get(name); value != "" {
+			kept.Set(name, value)
+		}
+	}
+	// A stale entry without validators can never be used again.
+	if lifetime <= 0 && kept.Get("ETag") == "" && kept.Get("Last-Modified") == "" {
+		storable = false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(url)
+	if !storable || int64(len(data)) > c.maxSize {
+		return
+	}
+	c.entries[url] = c.order.PushFront(&cacheEntry{url: url, data: data, header: kept, expires: now.Add(lifetime)})
+	c.size += int64(len(data))
+	for c.size > c.maxSize {
+		c.remove(c.order.Back().Value.(*cacheEntry).url)
+	}
+}
+
+// revalidated stores entry again with the headers of the 304 Not Modified response
+// that confirmed it, which update its freshness and validators.
+func (c *sourceCache) revalidated(entry *cacheEntry, header http.Header, now time.Time) {
+	merged := entry.header.Clone()
+	for _, name := range cachedHeaders {
+		if value := header.Get(name); value != "" {
+			merged.Set(name, value)
+		}
+	}
+	c.store(entry.url, entry.data, merged, now)
+}
+
+// remove drops the entry of url, if any. c.mu must be held.
+func (c *sourceCache) remove(url string) {
+	elem, ok := c.entries[url]
+	if !ok {
+		return
+	}
+	c.order.Remove(elem)
+	delete(c.entries, url)
+	c.size -= int64(len(elem.Value.(*cacheEntry).data))
+}
+
+// stats returns the current statistics of the cache.
+func (c *sourceCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Entries:       len(c.entries),
+		Size:          c.size,
+		MaxSize:       c.maxSize,
+		Hits:          c.hits.Load(),
+		Revalidations: c.revalidations.Load(),
+		Misses:        c.misses.Load(),
+	}
+}
+
+// freshness returns how long a response with the given header stays fresh from now,
+// and whether it may be stored at all. The lifetime comes from s-maxage or max-age,
+// then Expires, and otherwise is guessed as a tenth of the time since Last-Modified,
+// up to maxHeuristicLifetime. The Age of the response is deducted from it.
+func freshness(header http.Header, now time.Time) (time.Duration, bool) {
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := directives["private"]; ok {
+		return 0, false
+	}
+	if _, ok := directives["no-cache"]; ok {
+		return 0, true
+	}
+
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = now
+	}
+
+	var lifetime time.Duration
+	if seconds, ok := directiveSeconds(directives, "s-maxage"); ok {
+		lifetime = seconds
+	} else if seconds, ok := directiveSeconds(directives, "max-age"); ok {
+		lifetime = seconds
+	} else if expires := header.Get("Expires"); expires != "" {
+		// An invalid Expires, such as "0", means already expired.
+		if t, err := http.ParseTime(expires); err == nil {
+			lifetime = t.Sub(date)
+		}
+	} else if t, err := http.ParseTime(header.Get("Last-Modified")); err == nil && t.Before(date) {
+		lifetime = min(date.Sub(t)/10, maxHeuristicLifetime)
+	}
+
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && age > 0 {
+		lifetime -= time.Duration(min(age, maxLifetimeSeconds)) * time.Second
+	}
+	return lifetime, true
+}
+
+// parseCacheControl returns the directives of a Cache-Control header, keyed by their
+// lowercase name, with their unquoted value if any.
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return directives
+}
+
+// directiveSeconds returns the value of a delta-seconds directive such as max-age.
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, true
+	}
+	// Keep absurd lifetimes from overflowing a time.Duration.
+	return time.Duration(min(seconds, maxLifetimeSeconds)) * time.Second, true
+}
@@ -0,0 +1,400 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"neko-love/services/flight"
+)
+
+var (
+	// ErrInvalidURL is returned for URLs that are malformed or do not use http or https.
+	ErrInvalidURL = errors.New("invalid image URL")
+	// ErrForbiddenAddress is returned when the URL, or one of its redirects, resolves to
+	// a loopback, private, link-local or otherwise non-public address.
+	ErrForbiddenAddress = errors.New("destination address is not allowed")
+	// ErrHostNotAllowed is returned when the host of the URL, or of one of its redirects,
+	// is denied by Options.DenyHosts or missing from Options.AllowHosts.
+	ErrHostNotAllowed = errors.New("image host is not allowed")
+	// ErrTooManyRedirects is returned when the server redirects more than Options.MaxRedirects times.
+	ErrTooManyRedirects = errors.New("too many redirects")
+	// ErrTooLarge is returned, as a *SizeError, when the response body exceeds the maximum size.
+	ErrTooLarge = errors.New("image exceeds the maximum size")
+	// ErrUnsupportedType is returned when the response is declared as something else than an image.
+	ErrUnsupportedType = errors.New("response is not an image")
+)
+
+// StatusError is the cause of an Error with code CodeUpstreamStatus: the server answered
+// with a status other than 200 OK.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.Code)
+}
+
+// SizeError is the cause of an Error with code CodeTooLarge. It matches ErrTooLarge with errors.Is.
+type SizeError struct {
+	// Limit is the maximum size that applied to the download, in bytes.
+	Limit int64
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("image exceeds the maximum size of %d bytes", e.Limit)
+}
+
+func (e *SizeError) Is(target error) bool {
+	return target == ErrTooLarge
+}
+
+// Code is a machine-readable kind of fetch failure, suitable for API responses.
+type Code string
+
+const (
+	// CodeInvalidURL means the URL is malformed or does not use http or https.
+	CodeInvalidURL Code = "invalid_url"
+	// CodeUnsupportedScheme means no Source is registered for the scheme of the URL.
+	CodeUnsupportedScheme Code = "unsupported_scheme"
+	// CodeNotFound means a local image, such as an asset, does not exist.
+	CodeNotFound Code = "not_found"
+	// CodeForbiddenAddress means the URL, or one of its redirects, points to a non-public address.
+	CodeForbiddenAddress Code = "forbidden_address"
+	// CodeHostNotAllowed means the URL, or one of its redirects, points to a host that is not allowed.
+	CodeHostNotAllowed Code = "host_not_allowed"
+	// CodeUpstreamStatus means the server answered with an error status.
+	CodeUpstreamStatus Code = "upstream_status"
+	// CodeUpstreamError means the server could not be reached or misbehaved, for instance
+	// by failing mid-body or redirecting too many times or to an unsupported URL.
+	CodeUpstreamError Code = "upstream_error"
+	// CodeTimeout means the connection or the download did not finish in time.
+	CodeTimeout Code = "timeout"
+	// CodeTooLarge means the image is larger than the maximum size for its host.
+	CodeTooLarge Code = "too_large"
+	// CodeUnsupportedType means the response is declared as something else than an image.
+	CodeUnsupportedType Code = "unsupported_type"
+)
+
+// Error is the error returned by Fetch. Code tells what went wrong, and Err holds the
+// underlying cause, which is one of the package errors, a *StatusError or a network error.
+type Error struct {
+	Code Code
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// fetchError wraps err into an *Error, deriving its code from the cause.
+func fetchError(err error) *Error {
+	var statusErr *StatusError
+	var netErr net.Error
+	code := CodeUpstreamError
+
+	switch {
+	case errors.Is(err, ErrForbiddenAddress):
+		code = CodeForbiddenAddress
+	case errors.Is(err, ErrHostNotAllowed):
+		code = CodeHostNotAllowed
+	case errors.Is(err, ErrTooLarge):
+		code = CodeTooLarge
+	case errors.Is(err, ErrUnsupportedType):
+		code = CodeUnsupportedType
+	case errors.As(err, &statusErr):
+		code = CodeUpstreamStatus
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		code = CodeTimeout
+	}
+	return &Error{Code: code, Err: err}
+}
+
+// Options configures a Fetcher.
+type Options struct {
+	// ConnectTimeout bounds establishing each connection, TLS handshake included.
+	ConnectTimeout time.Duration
+	// ReadTimeout bounds the whole download, from sending the request to reading
+	// the last byte of the body, redirects included.
+	ReadTimeout time.Duration
+	// MaxSize is the largest response body accepted, in bytes.
+	MaxSize int64
+	// MaxRedirects is the number of redirects followed before giving up.
+	MaxRedirects int
+	// AllowPrivate disables the destination address checks. It is meant for tests
+	// against a local httptest server and for deployments fetching from a trusted network.
+	AllowPrivate bool
+	// UserAgent is the User-Agent header sent with every request. Empty uses the Go default.
+	UserAgent string
+
+	// AllowHosts, when not empty, restricts downloads to the hosts matching one of its
+	// patterns. A pattern is either a host name, matched exactly, or a wildcard such as
+	// "*.example.com", which matches every subdomain of example.com at any depth but not
+	// example.com itself. Matching ignores case and the port of the URL.
+	AllowHosts []string
+	// DenyHosts lists the patterns of the hosts never downloaded from, even when they are
+	// allowed by AllowHosts.
+	DenyHosts []string
+	// Hosts maps host patterns to the settings used for the matching hosts.
+	Hosts map[string]HostPolicy
+
+	// CacheSize is the total size, in bytes, of the downloaded images kept to answer
+	// later requests for the same URL, as allowed by their Cache-Control, Expires,
+	// ETag and Last-Modified headers. Zero disables the cache.
+	CacheSize int64
+}
+
+// DefaultOptions returns the options used by the API when nothing is configured.
+func DefaultOptions() Options {
+	return Options{
+		ConnectTimeout: 5 * time.Second,
+		ReadTimeout:    15 * time.Second,
+		MaxSize:        20 << 20,
+		MaxRedirects:   5,
+		CacheSize:      64 << 20,
+	}
+}
+
+// Fetcher downloads remote images on behalf of API clients. Since the URLs come from
+// untrusted clients, it only connects to public addresses, checking every address after
+// DNS resolution, including those reached through redirects, and it bounds the time and
+// memory spent on each download. Environment proxies are ignored, as they would hide the
+// real destination from these checks. Downloaded images are cached by URL, following the
+// caching headers of their host, so popular images are not downloaded for every request,
+// and concurrent requests for the same URL share a single download.
+type Fetcher struct {
+	client  *http.Client
+	opts    Options
+	cache   *sourceCache
+	flights flight.Group[string, []byte]
+}
+
+// New creates a Fetcher with the given options.
+func New(opts Options) *Fetcher {
+	dialer := &net.Dialer{Timeout: opts.ConnectTimeout}
+	if !opts.AllowPrivate {
+		dialer.Control = checkDestination
+	}
+
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: opts.ConnectTimeout,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	opts.AllowHosts = normalizeHosts(opts.AllowHosts)
+	opts.DenyHosts = normalizeHosts(opts.DenyHosts)
+	hosts := make(map[string]HostPolicy, len(opts.Hosts))
+	for pattern, policy := range opts.Hosts {
+		hosts[normalizeHost(pattern)] = policy
+	}
+	opts.Hosts = hosts
+
+	f := &Fetcher{opts: opts, cache: newSourceCache(opts.CacheSize)}
+	f.client = &http.Client{
+		Transport:     transport,
+		CheckRedirect: f.checkRedirect,
+	}
+	return f
+}
+
+// Fetch downloads the image at rawURL and returns its bytes. The download is cancelled
+// when ctx is done or Options.ReadTimeout elapses. Every failure is reported as an *Error
+// whose Code tells its kind; its cause can also be matched with errors.Is against the
+// package errors or with errors.As against *StatusError.
+//
+// Concurrent calls for the same URL share one download, which is not cancelled when the
+// ctx of one of its callers is done; that caller just stops waiting for it. The download
+// is only cancelled once every caller has stopped waiting. The returned
+// bytes may be shared with the cache and other callers, and must not be modified.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || !supportedScheme(u) {
+		return nil, &Error{Code: CodeInvalidURL, Err: fmt.Errorf("%w: %q", ErrInvalidURL, rawURL)}
+	}
+	if host := normalizeHost(u.Hostname()); !f.hostAllowed(host) {
+		return nil, &Error{Code: CodeHostNotAllowed, Err: fmt.Errorf("%w: %s", ErrHostNotAllowed, host)}
+	}
+
+	data, _, err := f.flights.Do(ctx, u.String(), func(ctx context.Context) ([]byte, error) {
+		return f.fetch(ctx, u)
+	})
+	if err != nil {
+		return nil, fetchError(err)
+	}
+	return data, nil
+}
+
+// fetch performs the download of Fetch, returning its errors unclassified. Fresh cached
+// images are returned right away, and stale ones are revalidated with a conditional request.
+func (f *Fetcher) fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	cached := f.cache.get(u.String())
+	if cached != nil && time.Now().Before(cached.expires) {
+		f.cache.hits.Add(1)
+		return cached.data, nil
+	}
+
+	if f.opts.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.opts.ReadTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "image/*")
+	f.setUserAgent(req)
+	if cached != nil {
+		if etag := cached.header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.header.Get("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		f.cache.revalidated(cached, resp.Header, time.Now())
+		f.cache.revalidations.Add(1)
+		return cached.data, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Code: resp.StatusCode}
+	}
+	if !imageContentType(resp.Header.Get("Content-Type")) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, resp.Header.Get("Content-Type"))
+	}
+
+	// The size limit is the one of the host that served the image, after redirects.
+	maxSize := f.hostPolicy(normalizeHost(resp.Request.URL.Hostname())).MaxSize
+	if resp.ContentLength > maxSize {
+		return nil, &SizeError{Limit: maxSize}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, &SizeError{Limit: maxSize}
+	}
+
+	if f.cache != nil {
+		f.cache.store(u.String(), data, resp.Header, time.Now())
+		f.cache.misses.Add(1)
+	}
+	return data, nil
+}
+
+// CacheStats returns the statistics of the cache of downloaded images. They are all
+// zero when the cache is disabled.
+func (f *Fetcher) CacheStats() CacheStats {
+	return f.cache.stats()
+}
+
+// setUserAgent sets the User-Agent header of req according to the policy of its host.
+func (f *Fetcher) setUserAgent(req *http.Request) {
+	if ua := f.hostPolicy(normalizeHost(req.URL.Hostname())).UserAgent; ua != "" {
+		req.Header.Set("User-Agent", ua)
+	} else {
+		req.Header.Del("User-Agent")
+	}
+}
+
+// checkRedirect is the http.Client redirect policy of the Fetcher. Redirects are held to
+// the same host rules as the original URL, and get the User-Agent of their own host. The
+// destination address of a redirect is checked when its connection is dialed, like any other.
+func (f *Fetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > f.opts.MaxRedirects {
+		return ErrTooManyRedirects
+	}
+	if !supportedScheme(req.URL) {
+		return fmt.Errorf("redirect to unsupported URL %q", req.URL)
+	}
+	if host := normalizeHost(req.URL.Hostname()); !f.hostAllowed(host) {
+		return fmt.Errorf("%w: redirect to %s", ErrHostNotAllowed, host)
+	}
+	f.setUserAgent(req)
+	return nil
+}
+
+// supportedScheme reports whether u is an absolute http or https URL.
+func supportedScheme(u *url.URL) bool {
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// imageContentType reports whether a response with the given Content-Type may hold an image.
+// Generic binary responses and responses without a type are let through, since many
+// hosts serve images that way; the decoder rejects them if they are not images.
+func imageContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "image/") || mediaType == "application/octet-stream"
+}
+
+// checkDestination is the net.Dialer Control function of the Fetcher. It runs for every
+// connection attempt, once the host name has been resolved, so it sees the real address.
+func checkDestination(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, address)
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !publicAddr(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	return nil
+}
+
+// nonPublicPrefixes lists the special-purpose ranges not covered by the netip.Addr predicates.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved, broadcast included
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, which can reach any IPv4 address
+}
+
+// publicAddr reports whether ip is a publicly routable unicast address.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
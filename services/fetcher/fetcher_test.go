@@ -0,0 +1,562 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testImage is the body served as an image by the test servers: its content does not
+// matter, since the Fetcher does not decode what it downloads.
+var testImage = bytes.Repeat([]byte("neko"), 256)
+
+// testOptions returns the options of a Fetcher downloading from local test servers.
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.AllowPrivate = true
+	opts.CacheSize = 0
+	return opts
+}
+
+// serve starts a test server answering every request with handler.
+func serve(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// serveImage is a handler answering with testImage as a PNG.
+func serveImage(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(testImage)
+}
+
+// wantCode checks that err is an *Error with the given code.
+func wantCode(t *testing.T, err error, code Code) {
+	t.Helper()
+	var fetchErr *Error
+	if !errors.As(err, &fetchErr) {
+		t.Fatalf("got error %v, want an *Error with code %s", err, code)
+	}
+	if fetchErr.Code != code {
+		t.Fatalf("got code %s (%v), want %s", fetchErr.Code, err, code)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	srv := serve(t, serveImage)
+	data, err := New(testOptions()).Fetch(context.Background(), srv.URL+"/neko.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testImage) {
+		t.Fatalf("got %d bytes, want the %d bytes served", len(data), len(testImage))
+	}
+}
+
+// TestFetchRefusesNonPublicAddresses checks that, unless AllowPrivate is set, the Fetcher
+// does not connect to loopback, private or link-local addresses, whether they are given
+// as literals, as IPv4-mapped IPv6 addresses or through a host name resolving to them.
+func TestFetchRefusesNonPublicAddresses(t *testing.T) {
+	var hits atomic.Int32
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		serveImage(w, r)
+	})
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+
+	opts := testOptions()
+	opts.AllowPrivate = false
+	opts.ConnectTimeout = time.Second
+	f := New(opts)
+
+	for _, host := range []string{
+		"127.0.0.1",
+		"localhost",
+		"[::1]",
+		"[::ffff:127.0.0.1]",
+		"[::ffff:7f00:1]",
+		"10.0.0.1",
+		"192.168.1.1",
+		"172.16.0.1",
+		"169.254.169.254",
+		"[fe80::1]",
+		"0.0.0.0",
+		"100.64.0.1",
+		"[64:ff9b::7f00:1]",
+	} {
+		t.Run(host, func(t *testing.T) {
+			_, err := f.Fetch(context.Background(), "http://"+host+":"+strconv.Itoa(port)+"/neko.png")
+			wantCode(t, err, CodeForbiddenAddress)
+			if !errors.Is(err, ErrForbiddenAddress) {
+				t.Fatalf("%v does not match ErrForbiddenAddress", err)
+			}
+		})
+	}
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("the server was reached %d times", n)
+	}
+}
+
+// TestFetchRefusesRedirectsToNonPublicAddresses checks that the destination of a redirect
+// is held to the same address checks as the URL given by the client.
+func TestFetchRefusesRedirectsToNonPublicAddresses(t *testing.T) {
+	private := serve(t, serveImage)
+	var target string
+	public := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+
+	opts := testOptions()
+	opts.AllowPrivate = false
+	f := New(opts)
+
+	// The test servers listen on loopback addresses: public.test stands for a public
+	// server, reached without the address checks, while every other dial is checked.
+	transport := f.client.Transport.(*http.Transport)
+	checked := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "public.test:80" {
+			var d net.Dialer
+			return d.DialContext(ctx, network, public.Listener.Addr().String())
+		}
+		return checked(ctx, network, addr)
+	}
+
+	privatePort := strconv.Itoa(private.Listener.Addr().(*net.TCPAddr).Port)
+	for _, host := range []string{"127.0.0.1", "localhost", "[::ffff:127.0.0.1]", "169.254.169.254"} {
+		t.Run(host, func(t *testing.T) {
+			target = "http://" + host + ":" + privatePort + "/neko.png"
+			_, err := f.Fetch(context.Background(), "http://public.test/redirect")
+			wantCode(t, err, CodeForbiddenAddress)
+		})
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"8.8.8.8":                true,
+		"2606:4700::1111":        true,
+		"::ffff:8.8.8.8":         true,
+		"127.0.0.1":              false,
+		"::1":                    false,
+		"::ffff:127.0.0.1":       false,
+		"::ffff:10.1.2.3":        false,
+		"10.1.2.3":               false,
+		"172.31.255.255":         false,
+		"192.168.0.1":            false,
+		"fd00::1":                false,
+		"169.254.169.254":        false,
+		"::ffff:169.254.169.254": false,
+		"fe80::1":                false,
+		"ff02::1":                false,
+		"224.0.0.1":              false,
+		"0.0.0.0":                false,
+		"::":                     false,
+		"100.64.0.1":             false,
+		"198.18.0.1":             false,
+		"255.255.255.255":        false,
+		"64:ff9b::a00:1":         false,
+	} {
+		if got := publicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("publicAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+// TestFetchSizeLimit checks the maximum size, whether the server announces the length of
+// the body or not, and that the limit of the host policy wins over the Fetcher-wide one.
+func TestFetchSizeLimit(t *testing.T) {
+	const maxSize = 1000
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		w.Header().Set("Content-Type", "image/png")
+		if r.URL.Query().Get("chunked") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+		}
+		for sent := 0; sent < size; sent += 100 {
+			w.Write(bytes.Repeat([]byte{'x'}, min(100, size-sent)))
+			w.(http.Flusher).Flush()
+		}
+	})
+
+	opts := testOptions()
+	opts.MaxSize = maxSize
+	f := New(opts)
+
+	for _, tc := range []struct {
+		query string
+		ok    bool
+	}{
+		{"size=1000", true},
+		{"size=1000&chunked=1", true},
+		{"size=1001", false},
+		{"size=1001&chunked=1", false},
+		{"size=1000000&chunked=1", false},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			data, err := f.Fetch(context.Background(), srv.URL+"/?"+tc.query)
+			if tc.ok {
+				if err != nil || len(data) != maxSize {
+					t.Fatalf("got %d bytes and error %v, want %d bytes", len(data), err, maxSize)
+				}
+				return
+			}
+			wantCode(t, err, CodeTooLarge)
+			var sizeErr *SizeError
+			if !errors.As(err, &sizeErr) || sizeErr.Limit != maxSize || !errors.Is(err, ErrTooLarge) {
+				t.Fatalf("got %v, want a *SizeError with limit %d", err, maxSize)
+			}
+		})
+	}
+
+	opts.Hosts = map[string]HostPolicy{"127.0.0.1": {MaxSize: 2000}}
+	if _, err := New(opts).Fetch(context.Background(), srv.URL+"/?size=1500&chunked=1"); err != nil {
+		t.Fatalf("host policy limit: %v", err)
+	}
+}
+
+func TestFetchContentType(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if contentType := r.URL.Query().Get("type"); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		} else {
+			// Without this, net/http would sniff a type from the body.
+			w.Header()["Content-Type"] = nil
+		}
+		w.Write(testImage)
+	})
+	f := New(testOptions())
+
+	for contentType, ok := range map[string]bool{
+		"":                              true,
+		"image/png":                     true,
+		"image/webp; charset=binary":    true,
+		"application/octet-stream":      true,
+		"text/html; charset=utf-8":      false,
+		"application/json":              false,
+		"image/png; invalid=parameter=": false,
+	} {
+		t.Run(contentType, func(t *testing.T) {
+			_, err := f.Fetch(context.Background(), srv.URL+"/?type="+url.QueryEscape(contentType))
+			if ok && err != nil {
+				t.Fatalf("got %v, want the image", err)
+			}
+			if !ok {
+				wantCode(t, err, CodeUnsupportedType)
+			}
+		})
+	}
+}
+
+// TestFetchTimeout checks that ReadTimeout bounds the download, whether the server is
+// slow to answer or to send the body, and that the caller's context is obeyed as well.
+func TestFetchTimeout(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(testImage[:10])
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	opts := testOptions()
+	opts.ReadTimeout = 100 * time.Millisecond
+	f := New(opts)
+	for _, path := range []string{"/slow-headers", "/slow-body"} {
+		t.Run(path, func(t *testing.T) {
+			start := time.Now()
+			_, err := f.Fetch(context.Background(), srv.URL+path)
+			wantCode(t, err, CodeTimeout)
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("gave up after %v", elapsed)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := New(testOptions()).Fetch(ctx, srv.URL+"/slow-headers")
+	wantCode(t, err, CodeTimeout)
+}
+
+// TestFetchErrorCodes checks the code of the other failures, which the API reports to
+// clients as is.
+func TestFetchErrorCodes(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/ftp":
+			http.Redirect(w, r, "ftp://example.com/neko.png", http.StatusFound)
+		case "/elsewhere":
+			http.Redirect(w, r, "http://denied.test/neko.png", http.StatusFound)
+		case "/truncated":
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Content-Length", "1000")
+			w.Write(testImage[:10])
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		default:
+			serveImage(w, r)
+		}
+	})
+
+	opts := testOptions()
+	opts.DenyHosts = []string{"denied.test", "*.Blocked.test"}
+	f := New(opts)
+
+	for _, tc := range []struct {
+		url  string
+		code Code
+	}{
+		{"not a url", CodeInvalidURL},
+		{"ftp://example.com/neko.png", CodeInvalidURL},
+		{"http:///neko.png", CodeInvalidURL},
+		{"http://denied.test/neko.png", CodeHostNotAllowed},
+		{"http://cdn.blocked.test./neko.png", CodeHostNotAllowed},
+		{srv.URL + "/elsewhere", CodeHostNotAllowed},
+		{srv.URL + "/missing", CodeUpstreamStatus},
+		{srv.URL + "/loop", CodeUpstreamError},
+		{srv.URL + "/ftp", CodeUpstreamError},
+		{srv.URL + "/truncated", CodeUpstreamError},
+		{"http://127.0.0.1:1/neko.png", CodeUpstreamError},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			_, err := f.Fetch(context.Background(), tc.url)
+			wantCode(t, err, tc.code)
+		})
+	}
+
+	_, err := f.Fetch(context.Background(), srv.URL+"/missing")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusNotFound {
+		t.Fatalf("got %v, want a *StatusError with code 404", err)
+	}
+	if _, err := f.Fetch(context.Background(), srv.URL+"/loop"); !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("got %v, want ErrTooManyRedirects", err)
+	}
+}
+
+// TestFetchAllowHosts checks that, with allow patterns, only the matching hosts are
+// downloaded from, redirects included.
+func TestFetchAllowHosts(t *testing.T) {
+	srv := serve(t, serveImage)
+	opts := testOptions()
+	opts.AllowHosts = []string{"127.0.0.1"}
+	f := New(opts)
+
+	if _, err := f.Fetch(context.Background(), srv.URL+"/neko.png"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := f.Fetch(context.Background(), strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)+"/neko.png")
+	wantCode(t, err, CodeHostNotAllowed)
+}
+
+// upstream is a test server for the cache, answering with body and the headers it is
+// set up with, or with 304 Not Modified to conditional requests matching its validators.
+type upstream struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	header   http.Header
+	body     []byte
+	requests []http.Header
+}
+
+func newUpstream(t *testing.T, header http.Header) *upstream {
+	t.Helper()
+	u := &upstream{}
+	u.set(header, testImage)
+	u.srv = serve(t, func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.requests = append(u.requests, r.Header.Clone())
+
+		for name, values := range u.header {
+			w.Header()[name] = values
+		}
+		etag, lastModified := u.header.Get("ETag"), u.header.Get("Last-Modified")
+		if (etag != "" && r.Header.Get("If-None-Match") == etag) ||
+			(lastModified != "" && r.Header.Get("If-Modified-Since") == lastModified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(u.body)
+	})
+	return u
+}
+
+// set replaces the headers and body of the responses. The header names are
+// canonicalized, so they can be written as in the specifications, such as ETag.
+func (u *upstream) set(header http.Header, body []byte) {
+	canonical := make(http.Header, len(header))
+	for name, values := range header {
+		canonical[http.CanonicalHeaderKey(name)] = values
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.header, u.body = canonical, body
+}
+
+// hits returns the number of requests received so far.
+func (u *upstream) hits() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.requests)
+}
+
+// lastRequest returns the headers of the last request received.
+func (u *upstream) lastRequest() http.Header {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.requests[len(u.requests)-1]
+}
+
+// cachingFetcher returns a Fetcher with its cache enabled.
+func cachingFetcher() *Fetcher {
+	opts := testOptions()
+	opts.CacheSize = 1 << 20
+	return New(opts)
+}
+
+// fetchBody fetches url with f and checks that it gets want.
+func fetchBody(t *testing.T, f *Fetcher, url string, want []byte) {
+	t.Helper()
+	data, err := f.Fetch(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("got %q, want %q", data, want)
+	}
+}
+
+// TestFetchCacheFreshness checks which responses are served again from the cache, by
+// counting the requests reaching the server for two downloads of the same URL.
+func TestFetchCacheFreshness(t *testing.T) {
+	now := time.Now()
+	date := now.UTC().Format(http.TimeFormat)
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		hits   int
+	}{
+		{"no caching headers", http.Header{}, 2},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=60"}}, 1},
+		{"s-maxage over max-age", http.Header{"Cache-Control": {"max-age=60, s-maxage=0"}}, 2},
+		{"max-age over Expires", http.Header{"Cache-Control": {"max-age=60"}, "Expires": {"0"}}, 1},
+		{"max-age used up by Age", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"60"}}, 2},
+		{"no-store", http.Header{"Cache-Control": {"no-store, max-age=60"}}, 2},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, 2},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache, max-age=60"}}, 2},
+		{"Expires", http.Header{"Date": {date}, "Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}}, 1},
+		{"past Expires", http.Header{"Date": {date}, "Expires": {now.Add(-time.Hour).UTC().Format(http.TimeFormat)}}, 2},
+		{"invalid Expires", http.Header{"Expires": {"0"}}, 2},
+		{"Last-Modified heuristic", http.Header{"Date": {date}, "Last-Modified": {now.Add(-100 * time.Hour).UTC().Format(http.TimeFormat)}}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := newUpstream(t, tc.header)
+			f := cachingFetcher()
+			fetchBody(t, f, u.srv.URL+"/neko.png", testImage)
+			fetchBody(t, f, u.srv.URL+"/neko.png", testImage)
+			if n := u.hits(); n != tc.hits {
+				t.Fatalf("the server was reached %d times, want %d", n, tc.hits)
+			}
+			if stats := f.CacheStats(); stats.Hits != int64(2-tc.hits) {
+				t.Fatalf("got %d cache hits, want %d", stats.Hits, 2-tc.hits)
+			}
+		})
+	}
+}
+
+// TestFetchCacheRevalidation checks that stale images are revalidated with the validators
+// they were served with, and that a 304 Not Modified renews their freshness.
+func TestFetchCacheRevalidation(t *testing.T) {
+	lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	for _, tc := range []struct {
+		name      string
+		validator string // the header sent by the server
+		condition string // the header of the conditional request
+		value     string
+	}{
+		{"ETag", "ETag", "If-None-Match", `"v1"`},
+		{"Last-Modified", "Last-Modified", "If-Modified-Since", lastModified},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := newUpstream(t, http.Header{"Cache-Control": {"no-cache"}, tc.validator: {tc.value}})
+			f := cachingFetcher()
+			url := u.srv.URL + "/neko.png"
+
+			fetchBody(t, f, url, testImage)
+			if got := u.lastRequest().Get(tc.condition); got != "" {
+				t.Fatalf("first request sent %s: %s", tc.condition, got)
+			}
+
+			fetchBody(t, f, url, testImage)
+			if got := u.lastRequest().Get(tc.condition); got != tc.value {
+				t.Fatalf("revalidation sent %s: %q, want %q", tc.condition, got, tc.value)
+			}
+			if stats := f.CacheStats(); stats.Revalidations != 1 || stats.Misses != 1 {
+				t.Fatalf("got stats %+v, want 1 revalidation and 1 miss", stats)
+			}
+
+			// The 304 makes the image fresh for a minute.
+			u.set(http.Header{"Cache-Control": {"max-age=60"}, tc.validator: {tc.value}}, testImage)
+			fetchBody(t, f, url, testImage)
+			fetchBody(t, f, url, testImage)
+			if n := u.hits(); n != 3 {
+				t.Fatalf("the server was reached %d times, want 3", n)
+			}
+			if stats := f.CacheStats(); stats.Hits != 1 || stats.Revalidations != 2 {
+				t.Fatalf("got stats %+v, want 1 hit and 2 revalidations", stats)
+			}
+		})
+	}
+}
+
+// TestFetchCacheDropsStale checks that a stale image is dropped, rather than kept with
+// its old validators, when the server answers with a new image that may not be stored.
+func TestFetchCacheDropsStale(t *testing.T) {
+	u := newUpstream(t, http.Header{"Cache-Control": {"no-cache"}, "ETag": {`"v1"`}})
+	f := cachingFetcher()
+	url := u.srv.URL + "/neko.png"
+	fetchBody(t, f, url, testImage)
+	if stats := f.CacheStats(); stats.Entries != 1 {
+		t.Fatalf("got %d entries, want the image cached", stats.Entries)
+	}
+
+	updated := []byte("a new image")
+	u.set(http.Header{"Cache-Control": {"no-store"}, "ETag": {`"v2"`}}, updated)
+	fetchBody(t, f, url, updated)
+	if got := u.lastRequest().Get("If-None-Match"); got != `"v1"` {
+		t.Fatalf("revalidation sent If-None-Match: %q", got)
+	}
+	if stats := f.CacheStats(); stats.Entries != 0 || stats.Size != 0 {
+		t.Fatalf("got stats %+v, want the stale image dropped", stats)
+	}
+
+	fetchBody(t, f, url, updated)
+	if got := u.lastRequest().Get("If-None-Match"); got != "" {
+		t.Fatalf("request sent If-None-Match: %q after the image was dropped", got)
+	}
+}
@@ -0,0 +1,78 @@
+package fetcher
+
+import (
+	"strings"
+)
+
+// HostPolicy holds the settings applied when downloading from a given host.
+// Zero fields fall back to the Fetcher-wide options.
+type HostPolicy struct {
+	// UserAgent is the User-Agent header sent to the host.
+	UserAgent string
+	// MaxSize is the largest response body accepted from the host, in bytes.
+	MaxSize int64
+}
+
+// hostAllowed reports whether images may be downloaded from host: it must not match
+// any deny pattern and, when allow patterns are set, it must match one of them.
+func (f *Fetcher) hostAllowed(host string) bool {
+	for _, pattern := range f.opts.DenyHosts {
+		if matchHost(pattern, host) {
+			return false
+		}
+	}
+	if len(f.opts.AllowHosts) == 0 {
+		return true
+	}
+	for _, pattern := range f.opts.AllowHosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPolicy returns the settings that apply to host, with the Fetcher-wide options
+// filling in what its policy leaves unset. An exact host pattern wins over wildcards,
+// and among wildcards the longest one wins.
+func (f *Fetcher) hostPolicy(host string) HostPolicy {
+	policy, ok := f.opts.Hosts[host]
+	if !ok {
+		best := -1
+		for pattern, p := range f.opts.Hosts {
+			if strings.HasPrefix(pattern, "*.") && matchHost(pattern, host) && len(pattern) > best {
+				policy, best = p, len(pattern)
+			}
+		}
+	}
+
+	if policy.UserAgent == "" {
+		policy.UserAgent = f.opts.UserAgent
+	}
+	if policy.MaxSize <= 0 {
+		policy.MaxSize = f.opts.MaxSize
+	}
+	return policy
+}
+
+// matchHost reports whether host matches pattern. Both must already be normalized.
+func matchHost(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return pattern == host
+}
+
+// normalizeHost lowercases host and removes its trailing dot, if any.
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// normalizeHosts returns the normalized copy of a list of host patterns.
+func normalizeHosts(patterns []string) []string {
+	normalized := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		normalized[i] = normalizeHost(pattern)
+	}
+	return normalized
+}
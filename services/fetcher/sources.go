@@ -0,0 +1,235 @@
+package fetcher
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrUnsupportedScheme is returned for references whose scheme has no registered Source.
+	ErrUnsupportedScheme = errors.New("unsupported image URL scheme")
+	// ErrNotFound is returned when a local image does not exist.
+	ErrNotFound = errors.New("image not found")
+)
+
+// Source loads the images referenced by URLs of one scheme.
+type Source interface {
+	// Load returns the bytes of the image referenced by ref. Errors are reported
+	// as an *Error, like those of Fetcher.Fetch.
+	Load(ctx context.Context, ref string) ([]byte, error)
+}
+
+// Load makes the Fetcher the Source of http and https URLs; it is the same as Fetch.
+func (f *Fetcher) Load(ctx context.Context, ref string) ([]byte, error) {
+	return f.Fetch(ctx, ref)
+}
+
+// Sources resolves image references given by clients, such as the "image" query parameter,
+// by handing each one to the Source registered for its scheme. Schemes that have not been
+// registered are rejected, which is how optional sources like file:// stay disabled.
+type Sources struct {
+	byScheme map[string]Source
+}
+
+// NewSources returns an empty set of sources.
+func NewSources() *Sources {
+	return &Sources{byScheme: make(map[string]Source)}
+}
+
+// Register makes src the Source of the references using scheme. It is not safe to
+// call once the Sources are in use.
+func (s *Sources) Register(scheme string, src Source) {
+	s.byScheme[strings.ToLower(scheme)] = src
+}
+
+// Load returns the bytes of the image referenced by ref, using the Source of its scheme.
+// It returns an *Error with code CodeInvalidURL when ref has no scheme and
+// CodeUnsupportedScheme when its scheme is not registered.
+func (s *Sources) Load(ctx context.Context, ref string) ([]byte, error) {
+	scheme, _, ok := strings.Cut(ref, ":")
+	if !ok || scheme == "" {
+		return nil, &Error{Code: CodeInvalidURL, Err: fmt.Errorf("%w: %q", ErrInvalidURL, ref)}
+	}
+
+	src, ok := s.byScheme[strings.ToLower(scheme)]
+	if !ok {
+		return nil, &Error{Code: CodeUnsupportedScheme, Err: fmt.Errorf("%w: %s", ErrUnsupportedScheme, scheme)}
+	}
+	return src.Load(ctx, ref)
+}
+
+// AssetLookup finds the files of the asset library, as cache.ImageCache does.
+type AssetLookup interface {
+	GetImagePath(category, name string) (string, bool)
+}
+
+// AssetSource loads images of the asset library from references such as
+// asset://neko/04.webp, made of the category and the file name.
+type AssetSource struct {
+	assets  AssetLookup
+	maxSize int64
+}
+
+// NewAssetSource returns a Source for the asset:// scheme, reading files found by
+// assets and refusing those larger than maxSize bytes.
+func NewAssetSource(assets AssetLookup, maxSize int64) *AssetSource {
+	return &AssetSource{assets: assets, maxSize: maxSize}
+}
+
+// Load implements Source.
+func (s *AssetSource) Load(_ context.Context, ref string) ([]byte, error) {
+	u, err := url.Parse(ref)
+	if err != nil || u.Host == "" {
+		return nil, &Error{Code: CodeInvalidURL, Err: fmt.Errorf("%w: %q", ErrInvalidURL, ref)}
+	}
+
+	category, name := u.Host, strings.TrimPrefix(u.Path, "/")
+	path, ok := s.assets.GetImagePath(category, name)
+	if !ok {
+		return nil, &Error{Code: CodeNotFound, Err: fmt.Errorf("%w: %s/%s", ErrNotFound, category, name)}
+	}
+	return readFile(path, s.maxSize)
+}
+
+// DataSource decodes images embedded in data URIs, such as data:image/png;base64,iVBORw0...
+type DataSource struct {
+	maxSize int64
+}
+
+// NewDataSource returns a Source for the data: scheme, refusing images larger than maxSize bytes.
+func NewDataSource(maxSize int64) *DataSource {
+	return &DataSource{maxSize: maxSize}
+}
+
+// Load implements Source. The media type, when given, must be an image type. Base64
+// payloads may omit their padding, and spaces are read as '+', since a '+' sent
+// unescaped in a query string arrives as a space.
+func (s *DataSource) Load(_ context.Context, ref string) ([]byte, error) {
+	invalid := &Error{Code: CodeInvalidURL, Err: fmt.Errorf("%w: malformed data URI", ErrInvalidURL)}
+
+	meta, payload, ok := strings.Cut(ref[len("data:"):], ",")
+	if !ok {
+		return nil, invalid
+	}
+	mediaType, isBase64 := strings.CutSuffix(meta, ";base64")
+	if !imageContentType(mediaType) {
+		return nil, &Error{Code: CodeUnsupportedType, Err: fmt.Errorf("%w: %s", ErrUnsupportedType, mediaType)}
+	}
+
+	if !isBase64 {
+		if int64(len(payload)) > s.maxSize*3 {
+			return nil, &Error{Code: CodeTooLarge, Err: &SizeError{Limit: s.maxSize}}
+		}
+		data, err := url.PathUnescape(payload)
+		if err != nil {
+			return nil, invalid
+		}
+		return s.checkSize([]byte(data))
+	}
+
+	payload = strings.TrimRight(strings.ReplaceAll(payload, " ", "+"), "=")
+	if int64(base64.RawStdEncoding.DecodedLen(len(payload))) > s.maxSize {
+		return nil, &Error{Code: CodeTooLarge, Err: &SizeError{Limit: s.maxSize}}
+	}
+	data, err := base64.RawStdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, invalid
+	}
+	return s.checkSize(data)
+}
+
+// checkSize returns data, or an error when it is larger than the maximum size.
+func (s *DataSource) checkSize(data []byte) ([]byte, error) {
+	if int64(len(data)) > s.maxSize {
+		return nil, &Error{Code: CodeTooLarge, Err: &SizeError{Limit: s.maxSize}}
+	}
+	return data, nil
+}
+
+// FileSource loads images from file:// URLs within a root directory of the server.
+// It gives clients read access to that directory, so it is only registered when a
+// deployment configures one.
+type FileSource struct {
+	root    string
+	maxSize int64
+}
+
+// NewFileSource returns a Source for the file:// scheme, limited to the files under
+// root, symbolic links resolved, and refusing files larger than maxSize bytes.
+func NewFileSource(root string, maxSize int64) *FileSource {
+	return &FileSource{root: root, maxSize: maxSize}
+}
+
+// Load implements Source. Paths outside the root directory, before or after resolving
+// symbolic links, are all reported with the same error, of code CodeForbiddenAddress, so
+// clients cannot tell which files exist outside of it.
+func (s *FileSource) Load(_ context.Context, ref string) ([]byte, error) {
+	u, err := url.Parse(ref)
+	if err != nil || (u.Host != "" && u.Host != "localhost") || u.Path == "" {
+		return nil, &Error{Code: CodeInvalidURL, Err: fmt.Errorf("%w: %q", ErrInvalidURL, ref)}
+	}
+	outside := &Error{Code: CodeForbiddenAddress, Err: fmt.Errorf("%w: %s is outside the file root", ErrForbiddenAddress, u.Path)}
+
+	root, err := filepath.Abs(s.root)
+	if err != nil {
+		return nil, &Error{Code: CodeNotFound, Err: fmt.Errorf("%w: file root: %v", ErrNotFound, err)}
+	}
+	// The path is checked as written before the file system is touched, so nothing
+	// outside the root, not even whether a file exists, is looked at.
+	path := filepath.Clean(filepath.FromSlash(u.Path))
+	if !within(root, path) {
+		return nil, outside
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, &Error{Code: CodeNotFound, Err: fmt.Errorf("%w: file root: %v", ErrNotFound, err)}
+	}
+	path, err = filepath.EvalSymlinks(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &Error{Code: CodeNotFound, Err: fmt.Errorf("%w: %s", ErrNotFound, u.Path)}
+	}
+	if err != nil {
+		return nil, &Error{Code: CodeInvalidURL, Err: fmt.Errorf("%w: %v", ErrInvalidURL, err)}
+	}
+	// Symbolic links under the root may still lead out of it.
+	if !within(resolvedRoot, path) {
+		return nil, outside
+	}
+	return readFile(path, s.maxSize)
+}
+
+// within reports whether path is root or lies under it. Both must be absolute and clean.
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// readFile reads the image file at path, refusing files larger than maxSize bytes.
+func readFile(path string, maxSize int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &Error{Code: CodeNotFound, Err: fmt.Errorf("%w: %s", ErrNotFound, filepath.Base(path))}
+	}
+	if err != nil {
+		return nil, &Error{Code: CodeNotFound, Err: err}
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxSize+1))
+	if err != nil {
+		return nil, &Error{Code: CodeNotFound, Err: err}
+	}
+	if int64(len(data)) > maxSize {
+		return nil, &Error{Code: CodeTooLarge, Err: &SizeError{Limit: maxSize}}
+	}
+	return data, nil
+}
@@ -0,0 +1,65 @@
+package fetcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFileSourceRoot checks that FileSource reads the files under its root, symbolic
+// links included, and refuses every path outside of it with the same error, whether
+// the path exists or not, so clients cannot probe the file system.
+func TestFileSourceRoot(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	for _, d := range []string{root, filepath.Join(root, "sub"), filepath.Join(dir, "secret")} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{filepath.Join(root, "sub", "neko.png"), filepath.Join(dir, "secret", "key.png")} {
+		if err := os.WriteFile(file, testImage, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(root, "sub", "neko.png"), filepath.Join(root, "inside.png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret"), filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	src := NewFileSource(root, 1<<20)
+	ref := func(path string) string { return "file://" + filepath.ToSlash(path) }
+	load := func(path string) error {
+		_, err := src.Load(context.Background(), ref(path))
+		return err
+	}
+
+	for _, path := range []string{filepath.Join(root, "sub", "neko.png"), filepath.Join(root, "inside.png"), root + "/sub/../inside.png"} {
+		if err := load(path); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+	wantCode(t, load(filepath.Join(root, "missing.png")), CodeNotFound)
+
+	// Each out-of-root path is reported as forbidden, whether it exists or not, with
+	// nothing but the path given by the client telling the errors apart.
+	for _, path := range []string{
+		filepath.Join(dir, "secret", "key.png"),
+		filepath.Join(dir, "secret", "missing.png"),
+		filepath.Join(dir, "missing", "missing.png"),
+		root + "/../secret/key.png",
+		root + "/../secret/missing.png",
+		filepath.Join(root, "escape", "key.png"),
+		root + "-sibling/neko.png",
+		"/",
+	} {
+		err := load(path)
+		wantCode(t, err, CodeForbiddenAddress)
+		if want := ErrForbiddenAddress.Error() + ": " + filepath.ToSlash(path) + " is outside the file root"; err.Error() != want {
+			t.Errorf("%s: got error %q, want %q", path, err, want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package flight
+
+import (
+	"context"
+	"sync"
+)
+
+// Group deduplicates concurrent calls doing the same work, so identical requests
+// arriving together share a single download or rendering: it runs at most one call per
+// key at a time, and callers asking for a key whose call is in flight wait for it and
+// receive its result. The zero Group is ready to use.
+type Group[K comparable, V any] struct {
+	mu    sync.Mutex
+	calls map[K]*call[V]
+}
+
+type call[V any] struct {
+	done chan struct{}
+	val  V
+	err  error
+
+	// waiters counts the callers waiting for the call, under Group.mu, and cancel
+	// stops it once they have all given up.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Do calls fn for key, unless a call for key is already in flight, and returns its
+// result. shared reports whether the result came from a call started by another caller.
+//
+// fn runs in its own goroutine with a context detached from the cancellation of ctx,
+// since the work is shared: a caller whose ctx is done stops waiting and returns
+// ctx.Err(), while fn keeps running for the other callers. Once every caller has given
+// up, the context of fn is cancelled, so no work goes on for nobody, and the key is
+// free for a new call.
+func (g *Group[K, V]) Do(ctx context.Context, key K, fn func(ctx context.Context) (V, error)) (v V, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[K]*call[V])
+	}
+	c, shared := g.calls[key]
+	if !shared {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &call[V]{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		go g.run(callCtx, key, c, fn)
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, shared, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+
+		var zero V
+		return zero, shared, ctx.Err()
+	}
+}
+
+// run calls fn for the call c of key and hands its result to the waiters.
+func (g *Group[K, V]) run(ctx context.Context, key K, c *call[V], fn func(ctx context.Context) (V, error)) {
+	defer func() {
+		g.mu.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+		c.cancel()
+		close(c.done)
+	}()
+
+	c.val, c.err = fn(ctx)
+}
@@ -0,0 +1,166 @@
+package flight
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waiters returns the number of callers waiting for the call of key, or -1 when no call
+// is in flight.
+func (g *Group[K, V]) waiters(key K) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.calls[key]; ok {
+		return c.waiters
+	}
+	return -1
+}
+
+// waitWaiters waits until n callers wait for the call of key.
+func waitWaiters[K comparable, V any](t *testing.T, g *Group[K, V], key K, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for g.waiters(key) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callers wait, want %d", g.waiters(key), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type result struct {
+	v      string
+	shared bool
+	err    error
+}
+
+// do calls g.Do in a new goroutine and returns a channel receiving its result.
+func do(ctx context.Context, g *Group[string, string], fn func(context.Context) (string, error)) <-chan result {
+	ch := make(chan result, 1)
+	go func() {
+		v, shared, err := g.Do(ctx, "key", fn)
+		ch <- result{v, shared, err}
+	}()
+	return ch
+}
+
+// TestCancelledCaller checks that a caller giving up returns its ctx.Err() at once, while
+// the call goes on for the caller still waiting.
+func TestCancelledCaller(t *testing.T) {
+	var g Group[string, string]
+	release := make(chan struct{})
+	fnErr := make(chan error, 1)
+	fn := func(ctx context.Context) (string, error) {
+		<-release
+		fnErr <- ctx.Err()
+		return "done", nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := do(ctx, &g, fn)
+	waitWaiters(t, &g, "key", 1)
+	waiting := do(context.Background(), &g, fn)
+	waitWaiters(t, &g, "key", 2)
+
+	cancel()
+	if r := <-cancelled; !errors.Is(r.err, context.Canceled) || r.v != "" {
+		t.Fatalf("cancelled caller: got %q, %v, want context.Canceled", r.v, r.err)
+	}
+	waitWaiters(t, &g, "key", 1)
+
+	close(release)
+	if r := <-waiting; r.err != nil || r.v != "done" || !r.shared {
+		t.Fatalf("waiting caller: got %+v, want the shared result", r)
+	}
+	if err := <-fnErr; err != nil {
+		t.Fatalf("the call was cancelled while a caller waited: %v", err)
+	}
+}
+
+// TestAllCancelled checks that the call is cancelled once all its callers gave up, and
+// that the key is free for a new call at once.
+func TestAllCancelled(t *testing.T) {
+	var g Group[string, string]
+	var calls atomic.Int32
+	stopped := make(chan struct{})
+	blocking := func(ctx context.Context) (string, error) {
+		calls.Add(1)
+		<-ctx.Done()
+		close(stopped)
+		return "", ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := do(ctx, &g, blocking)
+	second := do(ctx, &g, blocking)
+	waitWaiters(t, &g, "key", 2)
+	cancel()
+	for _, ch := range []<-chan result{first, second} {
+		if r := <-ch; !errors.Is(r.err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", r.err)
+		}
+	}
+	if n := g.waiters("key"); n != -1 {
+		t.Fatalf("the key is still in flight with %d callers", n)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the call was not cancelled")
+	}
+
+	v, shared, err := g.Do(context.Background(), "key", func(context.Context) (string, error) {
+		calls.Add(1)
+		return "again", nil
+	})
+	if err != nil || v != "again" || shared {
+		t.Fatalf("new call: got %q, %v, %v, want a result of its own", v, shared, err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("fn was called %d times, want 2", n)
+	}
+}
+
+// TestConcurrentCallers checks that concurrent callers share a single call.
+func TestConcurrentCallers(t *testing.T) {
+	const n = 16
+	var g Group[string, string]
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func(context.Context) (string, error) {
+		calls.Add(1)
+		<-release
+		return "done", nil
+	}
+
+	var wg sync.WaitGroup
+	var shared atomic.Int32
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, s, err := g.Do(context.Background(), "key", fn)
+			if err != nil || v != "done" {
+				t.Errorf("got %q, %v, want the result", v, err)
+			}
+			if s {
+				shared.Add(1)
+			}
+		}()
+	}
+	waitWaiters(t, &g, "key", n)
+	close(release)
+	wg.Wait()
+
+	if c := calls.Load(); c != 1 {
+		t.Fatalf("fn was called %d times, want 1", c)
+	}
+	if s := shared.Load(); s != n-1 {
+		t.Fatalf("%d callers shared the result, want %d", s, n-1)
+	}
+}
@@ -1,173 +1,232 @@
 package services
 
 import (
+	"context"
 	"errors"
 	"image"
-	"image/color"
-	"image/color/palette"
 	"image/draw"
 	"image/gif"
-	"image/jpeg"
-	"image/png"
+	"math/rand"
 	"neko-love/filters"
 
-	"github.com/chai2010/webp"
 	"github.com/gofiber/fiber/v2"
 )
 
-// ProcessGIF applies a specified filter to each frame of a given GIF image.
-// It processes each frame by converting it to RGBA, applying the filter, and then
-// converting it back to a paletted image while preserving transparency. The function
-// also maintains the original GIF's loop count, frame delays, and disposal methods.
+// ProcessGIF applies a filter pipeline to each frame of a given GIF image.
+// Every frame is first rebuilt as a full logical-screen image according to the GIF disposal
+// methods and frame offsets (see compositor), then every pipeline step runs on it, and
+// it is quantized back to a paletted image according to opts, with palette index 0 reserved
+// for transparency. The function keeps the original GIF's logical screen size, loop count and
+// frame delays. Since output frames are complete, each one is disposed to the background so
+// its transparent pixels never show the previous frame.
+// Frames are composited in order and handed to a pool of opts.Workers goroutines as they are
+// produced, which filter and quantize them concurrently, so only the frames in progress are
+// held at once, besides the filtered frames a global palette is built from. Each
+// frame gets its own random source derived from seed and the frame index, so random filters
+// vary from frame to frame while the whole animation stays reproducible whatever the scheduling.
+// When opts.Size is set, frames are scaled down to it before being filtered, and opts.Progress
+// is told about every filtered frame.
+// ctx is checked before each frame and by the filters within a frame: once it is done,
+// processing stops, every buffer is released and ctx.Err() is returned.
 //
 // Parameters:
-//   - filterName: The name of the filter to apply to each frame.
+//   - ctx: Cancels the processing.
+//   - pipeline: The filter steps to apply, in order, to each frame.
 //   - g: Pointer to the gif.GIF object to be processed.
+//   - seed: The seed of the random source used by random filters.
+//   - opts: The palette, dithering and worker count used to process the frames.
 //
 // Returns:
 //   - A pointer to a new gif.GIF object with the filter applied to each frame.
-//   - An error if the input GIF has no frames or if processing fails.
-func ProcessGIF(filterName string, g *gif.GIF) (*gif.GIF, error) {
+//   - An error if the input GIF has no frames, if processing fails or if ctx is done.
+func ProcessGIF(ctx context.Context, pipeline filters.Pipeline, g *gif.GIF, seed int64, opts GIFOptions) (*gif.GIF, error) {
 	if len(g.Image) == 0 {
 		return nil, errors.New("GIF has no frames")
 	}
 
+	screen := logicalScreen(g).Size()
+	if opts.Size != (image.Point{}) {
+		screen = opts.Size
+	}
 	result := &gif.GIF{
 		LoopCount: g.LoopCount,
 		Image:     make([]*image.Paletted, 0, len(g.Image)),
-		Delay:     make([]int, 0, len(g.Delay)),
-		Disposal:  make([]byte, 0, len(g.Disposal)),
+		Delay:     make([]int, 0, len(g.Image)),
+		Disposal:  make([]byte, 0, len(g.Image)),
+		Config:    image.Config{Width: screen.X, Height: screen.Y},
 	}
 
-	for i, frame := range g.Image {
-    bounds := g.Image[0].Bounds()
-    rgba := image.NewRGBA(bounds)
+	comp := newCompositor(g)
+	defer comp.release()
+
+	if opts.Palette == PaletteGlobal {
+		// The shared palette needs every filtered frame before any can be quantized.
+		frames := make([]*image.RGBA, len(g.Image))
+		err := parallelEach(ctx, len(g.Image), opts.Workers, comp.frame, func(i int, frame *image.RGBA) error {
+			var err error
+			frames[i], err = filterFrame(ctx, pipeline, frame, opts.Size, FrameSeed(seed, i))
+			if err == nil && opts.Progress != nil {
+				opts.Progress()
+			}
+			return err
+		}, filters.ReleaseRGBA)
+		if err != nil {
+			releaseFrames(frames, nil)
+			return nil, err
+		}
+		paletted, shared, err := quantizeFrames(ctx, frames, opts)
+		releaseFrames(frames, nil)
+		if err != nil {
+			releaseFrames(nil, paletted)
+			return nil, err
+		}
+		// As the global color table, the palette is written once instead of in every frame.
+		result.Config.ColorModel = shared
+		return assembleGIF(result, paletted, g.Delay), nil
+	}
+
+	// Quantize each frame in the worker that filtered it, releasing its RGBA buffers early.
+	paletted := make([]*image.Paletted, len(g.Image))
+	err := parallelEach(ctx, len(g.Image), opts.Workers, comp.frame, func(i int, frame *image.RGBA) error {
+		filtered, err := filterFrame(ctx, pipeline, frame, opts.Size, FrameSeed(seed, i))
+		if err != nil {
+			return err
+		}
+		paletted[i] = quantizeFrame(filtered, nil, opts.Dither)
+		filters.ReleaseRGBA(filtered)
+		if opts.Progress != nil {
+			opts.Progress()
+		}
+		return nil
+	}, filters.ReleaseRGBA)
+	if err != nil {
+		releaseFrames(nil, paletted)
+		return nil, err
+	}
+	return assembleGIF(result, paletted, g.Delay), nil
+}
 
-    draw.Draw(rgba, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+// filterFrame scales a composited frame down to size, unless size is zero, then applies
+// the pipeline to it, returning the filtered frame as RGBA. The frame is released, even
+// when filtering fails.
+func filterFrame(ctx context.Context, pipeline filters.Pipeline, frame *image.RGBA, size image.Point, seed int64) (*image.RGBA, error) {
+	if size != (image.Point{}) {
+		scaled, err := Downscale(ctx, frame, size)
+		filters.ReleaseRGBA(frame)
+		if err != nil {
+			return nil, err
+		}
+		frame = scaled
+	}
 
-    filtered := ApplyFilter(filterName, rgba)
+	result, err := ApplyFilter(ctx, pipeline, frame, seed)
+	if err != nil {
+		filters.ReleaseRGBA(frame)
+		return nil, err
+	}
+	filtered := toRGBA(result)
+	if filtered != frame {
+		filters.ReleaseRGBA(frame)
+	}
+	return filtered, nil
+}
 
-    palettedFrame := rgbaToPalettedWithTransparency(filtered)
+// releaseFrames hands back the frames left over by an interrupted ProcessGIF. Nil
+// entries are skipped.
+func releaseFrames(frames []*image.RGBA, paletted []*image.Paletted) {
+	for _, frame := range frames {
+		if frame != nil {
+			filters.ReleaseRGBA(frame)
+		}
+	}
+	for _, frame := range paletted {
+		if frame != nil {
+			filters.ReleasePaletted(frame)
+		}
+	}
+}
 
-    palettedFrame.Rect = bounds
+// ReleaseGIF hands the pixels of every frame of g back to the filter buffer pool, once
+// g has been encoded or is no longer needed. It is meant for GIFs returned by ProcessGIF
+// or decoded by gif.DecodeAll; g must not be used afterwards.
+func ReleaseGIF(g *gif.GIF) {
+	for _, frame := range g.Image {
+		filters.ReleasePaletted(frame)
+	}
+}
 
-    result.Image = append(result.Image, palettedFrame)
+// assembleGIF appends the paletted frames to result in order, with their delays taken
+// from the source GIF and a background disposal for every frame.
+func assembleGIF(result *gif.GIF, frames []*image.Paletted, delays []int) *gif.GIF {
+	for i, palettedFrame := range frames {
+		result.Image = append(result.Image, palettedFrame)
 
-    if i < len(g.Delay) {
-        result.Delay = append(result.Delay, g.Delay[i])
-    } else {
-        result.Delay = append(result.Delay, 0)
-    }
-    if i < len(g.Disposal) {
-        result.Disposal = append(result.Disposal, g.Disposal[i])
-    } else {
-        result.Disposal = append(result.Disposal, gif.DisposalNone)
-    }
-	}	
+		if i < len(delays) {
+			result.Delay = append(result.Delay, delays[i])
+		} else {
+			result.Delay = append(result.Delay, 0)
+		}
+		result.Disposal = append(result.Disposal, gif.DisposalBackground)
+	}
 
-	return result, nil
+	return result
 }
 
-// ApplyFilter applies the specified filter to the provided image and returns the resulting image.
-// Supported filters include: "blurple", "fuchsia", "glitch", "neon", "deepfry", "posterize", "pixelate", "vaporwave", "anime_outline".... .
-// If an unknown filter is provided, the original image is returned unmodified.
+// ApplyFilter applies the given filter pipeline to the provided image and returns the resulting image.
+// The image is converted to RGBA once, unless it already is one, then every step runs in order on
+// the in-memory result. Random filters draw from a source seeded with seed, so the same seed and
+// input always give the same output. img is never modified and still belongs to the caller.
+// The filters check ctx as they go, and give up with ctx.Err() once it is done.
 //
 // Parameters:
-//   - filter: the name of the filter to apply.
+//   - ctx: cancels the filtering.
+//   - pipeline: the filter steps to apply (see filters.ParsePipeline and filters.Single).
 //   - img: the image.Image to which the filter will be applied.
+//   - seed: the seed of the random source used by random filters.
 //
 // Returns:
-//   - image.Image: the filtered image.
-func ApplyFilter(filter string, img image.Image) image.Image {
-	rgba := image.NewRGBA(img.Bounds())
-	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
-
-	switch filter {
-		case "blurple":
-			return filters.Blurple(rgba)
-		case "fuchsia":
-			return filters.Fuchsia(rgba)
-		case "glitch":
-			return filters.Glitch(rgba)
-		case "poppink":
-			return filters.PopPink(rgba)
-		case "deepfry":
-			return filters.Deepfry(rgba)
-		case "posterize":
-			return filters.Posterize(rgba)
-		case "pixelate":
-			return filters.Pixelate(rgba)
-		case "vaporwave":
-			return filters.Vaporwave(rgba)
-		case "anime_outline":
-			return filters.AnimeOutline(rgba)
-		case "crimson":
-			return filters.Crimson(rgba)
-		case "amber":
-			return filters.Amber(rgba)
-		case "mint":
-			return filters.Mint(rgba)
-		case "aqua":
-			return filters.Aqua(rgba)
-		case "sunset":
-			return filters.Sunset(rgba)
-		case "bubblegum":
-			return filters.Bubblegum(rgba)
-		case "negative":
-			return filters.Negative(rgba)
-		case "greyscale":
-			return filters.Greyscale(rgba)
-		default:
-			return rgba
+//   - image.Image: the filtered image, which can be handed back with ReleaseImage once encoded.
+//   - error: ctx.Err() if ctx is done before the pipeline completes.
+func ApplyFilter(ctx context.Context, pipeline filters.Pipeline, img image.Image, seed int64) (image.Image, error) {
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = filters.NewRGBA(img.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
 	}
-}
-
-// rgbaToPalettedWithTransparency converts an RGBA image to a paletted image using the Plan9 palette,
-// ensuring that fully or partially transparent pixels are mapped to the first palette entry (index 0),
-// which is set to fully transparent. The function applies Floyd-Steinberg dithering for color quantization.
-// It returns the resulting *image.Paletted.
-func rgbaToPalettedWithTransparency(img image.Image) *image.Paletted {
-	bounds := img.Bounds()
-
-	p := make(color.Palette, len(palette.Plan9))
-	copy(p, palette.Plan9)
 
-	p[0] = color.RGBA{0, 0, 0, 0}
-
-	palettedImg := image.NewPaletted(bounds, p)
-
-	draw.FloydSteinberg.Draw(palettedImg, bounds, img, image.Point{})
+	result, err := pipeline.Apply(ctx, rgba, rand.New(rand.NewSource(seed)))
+	if !ok && result != image.Image(rgba) {
+		filters.ReleaseRGBA(rgba)
+	}
+	return result, err
+}
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			_, _, _, a := img.At(x, y).RGBA()
-			if uint8(a>>8) < 255 {
-				palettedImg.SetColorIndex(x, y, 0)
-			}
-		}
+// ReleaseImage hands the pixels of img back to the filter buffer pool so later requests
+// can reuse them. It is meant for images returned by ApplyFilter or decoded by the server,
+// once they have been encoded; other images are ignored. img must not be used afterwards.
+func ReleaseImage(img image.Image) {
+	switch img := img.(type) {
+	case *image.RGBA:
+		filters.ReleaseRGBA(img)
+	case *image.Paletted:
+		filters.ReleasePaletted(img)
 	}
+}
 
-	return palettedImg
+// FrameSeed derives the seed used for the given frame of an animation from the request seed.
+// The derivation only depends on its inputs, so frames can be processed in any order.
+func FrameSeed(seed int64, frame int) int64 {
+	// SplitMix64 finalizer, spreading consecutive frame indexes over the whole seed space.
+	z := uint64(seed) + uint64(frame+1)*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return int64(z ^ (z >> 31))
 }
 
-// EncodeAndSetContentType encodes the provided image.Image into the specified format
-// ("jpeg", "png", or "webp") and writes it to the Fiber context response body,
-// setting the appropriate Content-Type header. If the format is unrecognized,
-// it defaults to encoding as PNG. Returns an error if encoding fails.
-func EncodeAndSetContentType(c *fiber.Ctx, img image.Image, formatStr string) error {
-	switch formatStr {
-	case "jpeg":
-		c.Set("Content-Type", "image/jpeg")
-		return jpeg.Encode(c.Context().Response.BodyWriter(), img, &jpeg.Options{Quality: 90})
-	case "png":
-		c.Set("Content-Type", "image/png")
-		return png.Encode(c.Context().Response.BodyWriter(), img)
-	case "webp":
-		c.Set("Content-Type", "image/webp")
-		return webp.Encode(c.Context().Response.BodyWriter(), img, &webp.Options{Lossless: true})
-	default:
-		// Fallback: PNG
-		c.Set("Content-Type", "image/png")
-		return png.Encode(c.Context().Response.BodyWriter(), img)
-	}
-}
\ No newline at end of file
+// SetOutputHeaders sets the Content-Type, X-Image-Format and X-Image-Quality response
+// headers for an image encoded with opts.
+func SetOutputHeaders(c *fiber.Ctx, opts OutputOptions) {
+	c.Set("Content-Type", opts.ContentType())
+	c.Set("X-Image-Format", opts.Format)
+	c.Set("X-Image-Quality", opts.QualityLabel())
+}
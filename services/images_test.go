@@ -0,0 +1,139 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"os"
+	"testing"
+
+	"neko-love/filters"
+)
+
+// sampleGIF returns the bytes of example/original.gif, an animation of 21 frames.
+func sampleGIF(tb testing.TB) []byte {
+	tb.Helper()
+	data, err := os.ReadFile("../example/original.gif")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+// sampleJPEG returns the first frame of example/original.gif encoded as a JPEG, which
+// decodes to an *image.YCbCr like most photos sent to the API.
+func sampleJPEG(tb testing.TB) []byte {
+	tb.Helper()
+	frame, err := gif.Decode(bytes.NewReader(sampleGIF(tb)))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, frame, nil); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func mustPipeline(tb testing.TB, spec string) filters.Pipeline {
+	tb.Helper()
+	p, err := filters.ParsePipeline(spec)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+// TestApplyFilterLeavesRGBAInput checks that ApplyFilter, which filters an RGBA input in
+// place of a copy, neither modifies nor releases it: once the result is released and
+// other images are drawn from the pool, the input keeps its pixels.
+func TestApplyFilterLeavesRGBAInput(t *testing.T) {
+	src, _, err := image.Decode(bytes.NewReader(sampleJPEG(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := image.NewRGBA(src.Bounds())
+	draw.Draw(input, input.Bounds(), src, src.Bounds().Min, draw.Src)
+	before := bytes.Clone(input.Pix)
+
+	for _, spec := range []string{"negative", "deepfry,pixelate,glitch"} {
+		result, err := ApplyFilter(context.Background(), mustPipeline(t, spec), input, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result == image.Image(input) {
+			t.Fatalf("%s: result is the input image", spec)
+		}
+		ReleaseImage(result)
+
+		scratches := make([]*image.RGBA, 4)
+		for i := range scratches {
+			scratches[i] = filters.NewRGBA(input.Bounds())
+			for j := range scratches[i].Pix {
+				scratches[i].Pix[j] = 0xaa
+			}
+		}
+		if !bytes.Equal(input.Pix, before) {
+			t.Fatalf("%s: input pixels changed", spec)
+		}
+		for _, scratch := range scratches {
+			filters.ReleaseRGBA(scratch)
+		}
+	}
+}
+
+// BenchmarkStillImage measures a still-image request: decoding a JPEG, filtering it with a
+// two-step pipeline and encoding it, with the buffers handed back to the pool as the
+// server does.
+func BenchmarkStillImage(b *testing.B) {
+	data := sampleJPEG(b)
+	pipeline := mustPipeline(b, "deepfry,pixelate")
+	opts := OutputOptions{Format: "jpeg"}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		src, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		result, err := ApplyFilter(context.Background(), pipeline, src, 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := Encode(io.Discard, result, opts); err != nil {
+			b.Fatal(err)
+		}
+		ReleaseImage(result)
+		ReleaseImage(src)
+	}
+}
+
+// BenchmarkProcessGIF measures filtering every frame of example/original.gif, from the
+// decoded GIF to the paletted output frames, which are handed back to the pool.
+func BenchmarkProcessGIF(b *testing.B) {
+	g, err := gif.DecodeAll(bytes.NewReader(sampleGIF(b)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	pipeline := mustPipeline(b, "deepfry")
+
+	for _, palette := range []PaletteMode{PalettePerFrame, PaletteGlobal} {
+		b.Run(string(palette), func(b *testing.B) {
+			opts := DefaultGIFOptions()
+			opts.Palette = palette
+
+			b.ReportAllocs()
+			for b.Loop() {
+				result, err := ProcessGIF(context.Background(), pipeline, g, 1, opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				ReleaseGIF(result)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package jobs
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned by Manager.Submit when every worker is busy and the queue
+	// of pending jobs is full.
+	ErrQueueFull = errors.New("jobs: queue is full")
+	// ErrResultTooLarge is the error of a job whose result is larger than Options.ResultsSize.
+	ErrResultTooLarge = errors.New("jobs: result exceeds the size kept for results")
+)
+
+// Status is the stage of a job.
+type Status string
+
+const (
+	// Queued means the job waits for a worker.
+	Queued Status = "queued"
+	// Running means a worker is processing the job.
+	Running Status = "running"
+	// Done means the job completed and its result is available.
+	Done Status = "done"
+	// Failed means the job completed with an error.
+	Failed Status = "failed"
+)
+
+// Func is the work of a job. It returns the result of the job, and calls advance every
+// time one more of the units of work counted by the job is complete, possibly from
+// several goroutines. It should stop early with ctx.Err() once ctx is done.
+type Func func(ctx context.Context, advance func()) ([]byte, error)
+
+// Options configures a Manager.
+type Options struct {
+	// Workers is the number of jobs processed at once. Zero or negative means one.
+	Workers int
+	// QueueSize is the number of jobs waiting for a worker before Submit refuses more.
+	QueueSize int
+	// Timeout bounds the processing of a job. Zero disables it.
+	Timeout time.Duration
+	// TTL is how long a completed job and its result are kept.
+	TTL time.Duration
+	// ResultsSize is the total size, in bytes, of the results kept. When a new result
+	// does not fit, the jobs that completed first are forgotten early to make room for
+	// it, and a result larger than the whole budget fails its job. Zero or negative
+	// means no bound.
+	ResultsSize int64
+}
+
+// Manager runs jobs too long to be processed within an HTTP request on a pool of
+// workers, and keeps them, result included, for a while after they complete so their
+// clients can poll for them.
+type Manager struct {
+	opts  Options
+	queue chan *Job
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+	// done holds the jobs kept with a result, the first completed first, and size the
+	// total size of their results.
+	done list.List // of *Job
+	size int64
+}
+
+// New returns a manager configured by opts, whose workers are started at once.
+func New(opts Options) *Manager {
+	m := &Manager{
+		opts:  opts,
+		queue: make(chan *Job, max(opts.QueueSize, 0)),
+		jobs:  make(map[string]*Job),
+	}
+	for i := 0; i < max(opts.Workers, 1); i++ {
+		go m.work()
+	}
+	return m
+}
+
+// Submit queues a job running fn and counting total units of work, such as the frames
+// of an animation, with info describing it to the caller. It returns ErrQueueFull when
+// no worker can take it and the queue is full.
+func (m *Manager) Submit(total int, info any, fn Func) (*Job, error) {
+	job := &Job{ID: newID(), Created: time.Now(), Info: info, total: total, status: Queued, fn: fn}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case m.queue <- job:
+	default:
+		return nil, ErrQueueFull
+	}
+	m.jobs[job.ID] = job
+	return job, nil
+}
+
+// Get returns the job with the given ID, unless it does not exist or has expired.
+func (m *Manager) Get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+// work processes queued jobs, one at a time, until the program exits.
+func (m *Manager) work() {
+	for job := range m.queue {
+		m.run(job)
+	}
+}
+
+// run processes job and schedules its removal once its TTL has elapsed.
+func (m *Manager) run(job *Job) {
+	ctx := context.Background()
+	if m.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.opts.Timeout)
+		defer cancel()
+	}
+
+	job.start()
+	result, err := job.fn(ctx, job.advance)
+	if err == nil && m.opts.ResultsSize > 0 && int64(len(result)) > m.opts.ResultsSize {
+		result, err = nil, ErrResultTooLarge
+	}
+
+	m.mu.Lock()
+	if err == nil {
+		m.keep(job, int64(len(result)))
+	}
+	job.finish(result, err, time.Now().Add(m.opts.TTL))
+	m.mu.Unlock()
+
+	time.AfterFunc(m.opts.TTL, func() {
+		m.mu.Lock()
+		m.remove(job)
+		m.mu.Unlock()
+	})
+}
+
+// keep accounts for the result of job, of the given size, forgetting the jobs that
+// completed first until it fits within Options.ResultsSize. m.mu must be held.
+func (m *Manager) keep(job *Job, size int64) {
+	job.elem, job.size = m.done.PushBack(job), size
+	m.size += size
+	for m.opts.ResultsSize > 0 && m.size > m.opts.ResultsSize {
+		m.remove(m.done.Front().Value.(*Job))
+	}
+}
+
+// remove forgets job, releasing its result if it has one. m.mu must be held.
+func (m *Manager) remove(job *Job) {
+	delete(m.jobs, job.ID)
+	if job.elem != nil {
+		m.done.Remove(job.elem)
+		m.size -= job.size
+		job.elem = nil
+	}
+	job.forget()
+}
+
+// Job is a unit of work submitted to a Manager.
+type Job struct {
+	// ID identifies the job. It is random, so it cannot be guessed by other clients.
+	ID string
+	// Created is the time the job was submitted.
+	Created time.Time
+	// Info is the description given to Submit, which the Manager does not use.
+	Info any
+
+	fn Func
+	// elem is the element of the job in Manager.done and size the size of its result,
+	// both guarded by the mutex of the Manager.
+	elem *list.Element
+	size int64
+
+	mu      sync.Mutex
+	status  Status
+	done    int
+	total   int
+	result  []byte
+	err     error
+	expires time.Time
+	// forgotten tells the job was removed from its Manager, result included.
+	forgotten bool
+}
+
+// Snapshot is the state of a job at some point in time.
+type Snapshot struct {
+	ID      string
+	Status  Status
+	Created time.Time
+	// Done and Total count the units of work of the job, complete and overall.
+	Done  int
+	Total int
+	// Err is the error of a failed job.
+	Err error
+	// Expires is the time a completed job is removed, and zero before it completes.
+	Expires time.Time
+}
+
+// Snapshot returns the current state of the job.
+func (j *Job) Snapshot() Snapshot {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return Snapshot{
+		ID:      j.ID,
+		Status:  j.status,
+		Created: j.Created,
+		Done:    j.done,
+		Total:   j.total,
+		Err:     j.err,
+		Expires: j.expires,
+	}
+}
+
+// Result returns the result of the job and true once it is done, and false otherwise,
+// including once the Manager has forgotten the job. The result must not be modified.
+func (j *Job) Result() ([]byte, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.result, j.status == Done && !j.forgotten
+}
+
+func (j *Job) start() {
+	j.mu.Lock()
+	j.status = Running
+	j.mu.Unlock()
+}
+
+// advance counts one more unit of work as complete, never going past the total.
+func (j *Job) advance() {
+	j.mu.Lock()
+	j.done = min(j.done+1, j.total)
+	j.mu.Unlock()
+}
+
+// forget releases the result of a job removed from its Manager.
+func (j *Job) forget() {
+	j.mu.Lock()
+	j.result, j.forgotten = nil, true
+	j.mu.Unlock()
+}
+
+func (j *Job) finish(result []byte, err error, expires time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.expires = expires
+	j.fn = nil
+	if err != nil {
+		j.status, j.err = Failed, err
+		return
+	}
+	j.status, j.result, j.done = Done, result, j.total
+}
+
+// newID returns a random job ID of 128 bits, in hexadecimal.
+func newID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,111 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// resultOf returns a Func completing at once with a result of size bytes.
+func resultOf(size int) Func {
+	return func(context.Context, func()) ([]byte, error) {
+		return make([]byte, size), nil
+	}
+}
+
+// wait returns the snapshot of job once it has completed.
+func wait(t *testing.T, job *Job) Snapshot {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := job.Snapshot()
+		if s.Status == Done || s.Status == Failed {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s still %s", job.ID, s.Status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestResultsSize checks that the results kept stay within Options.ResultsSize, the jobs
+// completed first being forgotten first, and that a result larger than the whole budget
+// fails its job.
+func TestResultsSize(t *testing.T) {
+	m := New(Options{Workers: 1, QueueSize: 8, TTL: time.Hour, ResultsSize: 100})
+
+	var done []*Job
+	for _, size := range []int{40, 40, 30} {
+		job, err := m.Submit(1, nil, resultOf(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wait(t, job)
+		done = append(done, job)
+	}
+	// 40 + 40 + 30 exceeds 100: the first job made room for the last one.
+	if _, ok := m.Get(done[0].ID); ok {
+		t.Error("the first job is still kept")
+	}
+	if _, ok := done[0].Result(); ok {
+		t.Error("the first job still has its result")
+	}
+	for _, job := range done[1:] {
+		if _, ok := m.Get(job.ID); !ok {
+			t.Errorf("job %s was forgotten", job.ID)
+		}
+		if body, ok := job.Result(); !ok || body == nil {
+			t.Errorf("job %s has no result", job.ID)
+		}
+	}
+	m.mu.Lock()
+	size := m.size
+	m.mu.Unlock()
+	if size != 70 {
+		t.Errorf("kept results take %d bytes, want 70", size)
+	}
+
+	job, err := m.Submit(1, nil, resultOf(101))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := wait(t, job); s.Status != Failed || !errors.Is(s.Err, ErrResultTooLarge) {
+		t.Fatalf("got status %s and error %v, want ErrResultTooLarge", s.Status, s.Err)
+	}
+	for _, job := range done[1:] {
+		if _, ok := m.Get(job.ID); !ok {
+			t.Errorf("job %s was forgotten for a result that is not kept", job.ID)
+		}
+	}
+}
+
+// TestTTL checks that completed jobs are forgotten once their TTL has elapsed, releasing
+// the room taken by their results.
+func TestTTL(t *testing.T) {
+	m := New(Options{Workers: 1, QueueSize: 1, TTL: 10 * time.Millisecond, ResultsSize: 100})
+	job, err := m.Submit(1, nil, resultOf(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait(t, job)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, ok := m.Get(job.ID)
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("job kept past its TTL")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	m.mu.Lock()
+	size := m.size
+	m.mu.Unlock()
+	if size != 0 {
+		t.Fatalf("expired results still take %d bytes", size)
+	}
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+)
+
+// Limits bounds the images the server agrees to decode, so a small crafted file cannot
+// make it allocate gigabytes. Zero values disable the matching limit.
+type Limits struct {
+	// MaxWidth and MaxHeight bound the dimensions of the image, in pixels.
+	MaxWidth  int
+	MaxHeight int
+	// MaxPixels bounds the pixels decoded for the whole image: its area, times its
+	// number of frames for an animation.
+	MaxPixels int64
+	// MaxFrames bounds the number of frames of an animation.
+	MaxFrames int
+	// Downscale scales images exceeding MaxWidth or MaxHeight down to fit, instead of
+	// rejecting them. MaxPixels and MaxFrames are always enforced, since the image has
+	// to be decoded before it can be scaled.
+	Downscale bool
+}
+
+// LimitError reports an image exceeding one of the Limits.
+type LimitError struct {
+	// Limit names the exceeded limit: "width", "height", "megapixels" or "frames".
+	Limit string
+	// Value is the size of the image and Max the limit, both in the unit of Limit.
+	Value float64
+	Max   float64
+}
+
+func (e *LimitError) Error() string {
+	switch e.Limit {
+	case "frames":
+		// Frames are only counted up to one past the limit.
+		return fmt.Sprintf("image has more than %g frames", e.Max)
+	case "megapixels":
+		return fmt.Sprintf("image of %g megapixels exceeds the maximum of %g", e.Value, e.Max)
+	default:
+		return fmt.Sprintf("image %s of %g pixels exceeds the maximum of %g", e.Limit, e.Value, e.Max)
+	}
+}
+
+// ImageInfo describes an encoded image as read from its header, without decoding it.
+type ImageInfo struct {
+	// Format is the format name, as returned by image.DecodeConfig.
+	Format string
+	Width  int
+	Height int
+	// Frames is the number of frames of a GIF, and 1 for other images.
+	Frames int
+}
+
+// InspectImage reads the header of the encoded image data with image.DecodeConfig and,
+// for GIFs, counts the frames by walking the blocks of the file without decompressing
+// them. Counting stops past maxFrames, when it is positive, which is enough to reject
+// the image.
+func InspectImage(data []byte, maxFrames int) (ImageInfo, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ImageInfo{}, err
+	}
+
+	info := ImageInfo{Format: format, Width: config.Width, Height: config.Height, Frames: 1}
+	if format == "gif" {
+		info.Frames = gifFrameCount(data, maxFrames)
+	}
+	return info, nil
+}
+
+// Check returns an error when info exceeds the limits. Otherwise it returns the size the
+// image must be scaled down to, when Downscale is set and the image is wider or taller
+// than allowed, or the zero point when it can be used as is.
+func (l Limits) Check(info ImageInfo) (image.Point, error) {
+	if l.MaxFrames > 0 && info.Frames > l.MaxFrames {
+		return image.Point{}, &LimitError{Limit: "frames", Value: float64(info.Frames), Max: float64(l.MaxFrames)}
+	}
+	if pixels := int64(info.Width) * int64(info.Height) * int64(info.Frames); l.MaxPixels > 0 && pixels > l.MaxPixels {
+		return image.Point{}, &LimitError{Limit: "megapixels", Value: float64(pixels) / 1e6, Max: float64(l.MaxPixels) / 1e6}
+	}
+
+	tooWide := l.MaxWidth > 0 && info.Width > l.MaxWidth
+	tooTall := l.MaxHeight > 0 && info.Height > l.MaxHeight
+	switch {
+	case (tooWide || tooTall) && l.Downscale:
+		return fitSize(info.Width, info.Height, l.MaxWidth, l.MaxHeight), nil
+	case tooWide:
+		return image.Point{}, &LimitError{Limit: "width", Value: float64(info.Width), Max: float64(l.MaxWidth)}
+	case tooTall:
+		return image.Point{}, &LimitError{Limit: "height", Value: float64(info.Height), Max: float64(l.MaxHeight)}
+	}
+	return image.Point{}, nil
+}
+
+// fitSize returns the largest size with the aspect ratio of width x height fitting in
+// maxWidth x maxHeight, a zero maximum leaving that dimension free.
+func fitSize(width, height, maxWidth, maxHeight int) image.Point {
+	scale := 1.0
+	if maxWidth > 0 {
+		scale = min(scale, float64(maxWidth)/float64(width))
+	}
+	if maxHeight > 0 {
+		scale = min(scale, float64(maxHeight)/float64(height))
+	}
+	return image.Point{
+		X: max(1, int(math.Round(float64(width)*scale))),
+		Y: max(1, int(math.Round(float64(height)*scale))),
+	}
+}
+
+// gifFrameCount counts the image descriptors of the GIF data, stopping past limit when
+// it is positive. Malformed or truncated data ends the count early; the decoder reports
+// the error later.
+func gifFrameCount(data []byte, limit int) int {
+	// Header (6 bytes) and logical screen descriptor (7 bytes), then the global color table.
+	const headerSize = 13
+	if len(data) < headerSize {
+		return 0
+	}
+	pos := headerSize
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension: introducer, label, then data sub-blocks
+			pos = skipSubBlocks(data, pos+2)
+		case 0x2c: // image descriptor (10 bytes), local color table, LZW code size, sub-blocks
+			if pos+10 > len(data) {
+				return frames
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			pos = skipSubBlocks(data, pos+1)
+			frames++
+			if limit > 0 && frames > limit {
+				return frames
+			}
+		default: // trailer, or garbage
+			return frames
+		}
+	}
+	return frames
+}
+
+// skipSubBlocks returns the position following the data sub-blocks starting at pos,
+// which end with an empty block.
+func skipSubBlocks(data []byte, pos int) int {
+	for pos < len(data) {
+		size := int(data[pos])
+		pos++
+		if size == 0 {
+			return pos
+		}
+		pos += size
+	}
+	return pos
+}
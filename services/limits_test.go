@@ -0,0 +1,247 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+// gifHeader returns the header and logical screen descriptor of a 1x1 GIF, followed by
+// a global color table of 2^(size+1) entries when size is not negative.
+func gifHeader(size int) []byte {
+	b := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00")
+	if size >= 0 {
+		b[10] = 0x80 | byte(size)
+		b = append(b, bytes.Repeat([]byte{0x2c}, 3<<(size+1))...)
+	}
+	return b
+}
+
+// gifFrame returns the image descriptor of a 1x1 frame, with a local color table of
+// 2^(size+1) entries when size is not negative, and its LZW data holding a single
+// pixel of index 0. The color tables are filled with the byte introducing an image
+// descriptor, so a parser reading them as blocks would count frames that do not exist.
+func gifFrame(size int) []byte {
+	b := []byte{0x2c, 0, 0, 0, 0, 1, 0, 1, 0, 0}
+	if size >= 0 {
+		b[9] = 0x80 | byte(size)
+		b = append(b, bytes.Repeat([]byte{0x2c}, 3<<(size+1))...)
+	}
+	return append(b, 0x02, 0x02, 0x44, 0x01, 0x00)
+}
+
+// gifExtension returns an extension block with the given label and data sub-blocks.
+func gifExtension(label byte, blocks ...[]byte) []byte {
+	b := []byte{0x21, label}
+	for _, block := range blocks {
+		b = append(b, byte(len(block)))
+		b = append(b, block...)
+	}
+	return append(b, 0x00)
+}
+
+// gifTrailer ends a GIF.
+var gifTrailer = []byte{0x3b}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// graphicControl is a graphic control extension whose data holds the byte introducing an
+// image descriptor.
+var graphicControl = gifExtension(0xf9, []byte{0x04, 0x2c, 0x00, 0x2c})
+
+// TestGIFFrameCount checks the frame count of well-formed GIFs against image/gif, and
+// how malformed and truncated ones end the count.
+func TestGIFFrameCount(t *testing.T) {
+	wellFormed := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no frames", concat(gifHeader(-1), gifTrailer), 0},
+		{"one frame", concat(gifHeader(0), gifFrame(-1), gifTrailer), 1},
+		{"global color table", concat(gifHeader(7), gifFrame(-1), gifFrame(-1), gifTrailer), 2},
+		{"local color tables", concat(gifHeader(-1), gifFrame(0), gifFrame(7), gifFrame(3), gifTrailer), 3},
+		{"extensions", concat(
+			gifHeader(1),
+			gifExtension(0xff, []byte("NETSCAPE2.0"), []byte{0x01, 0x00, 0x00}),
+			gifExtension(0xfe, []byte("made, with \x2c and \x21"), bytes.Repeat([]byte{0x2c}, 255)),
+			graphicControl, gifFrame(-1),
+			graphicControl, gifFrame(2),
+			gifTrailer,
+		), 2},
+	}
+	for _, tc := range wellFormed {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := gifFrameCount(tc.data, 0); got != tc.want {
+				t.Errorf("got %d frames, want %d", got, tc.want)
+			}
+			g, err := gif.DecodeAll(bytes.NewReader(tc.data))
+			if err != nil {
+				if tc.want == 0 {
+					return // image/gif refuses GIFs without frames
+				}
+				t.Fatalf("test GIF does not decode: %v", err)
+			}
+			if len(g.Image) != tc.want {
+				t.Fatalf("test GIF decodes to %d frames, want %d", len(g.Image), tc.want)
+			}
+		})
+	}
+
+	twoFrames := concat(gifHeader(0), graphicControl, gifFrame(1), gifFrame(-1), gifTrailer)
+	firstFrameEnd := len(gifHeader(0)) + len(graphicControl) + len(gifFrame(1))
+	malformed := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"empty", nil, 0},
+		{"truncated header", gifHeader(-1)[:12], 0},
+		{"no trailer", concat(gifHeader(-1), gifFrame(-1)), 1},
+		{"truncated global color table", gifHeader(7)[:100], 0},
+		{"truncated extension", twoFrames[:len(gifHeader(0))+3], 0},
+		{"truncated image descriptor", twoFrames[:firstFrameEnd+5], 1},
+		// A frame whose data is cut short is still counted: it is the decoder that
+		// reports the truncation.
+		{"truncated local color table", twoFrames[:firstFrameEnd-8], 1},
+		{"truncated image data", twoFrames[:len(twoFrames)-3], 2},
+		{"garbage block", concat(gifHeader(-1), gifFrame(-1), []byte{0x00}, gifFrame(-1), gifTrailer), 1},
+		{"sub-block past the end", concat(gifHeader(-1), gifFrame(-1)[:10], []byte{0x02, 0xff}), 1},
+	}
+	for _, tc := range malformed {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := gifFrameCount(tc.data, 0); got != tc.want {
+				t.Errorf("got %d frames, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestGIFFrameCountLimit checks that counting stops once it has gone past the limit.
+func TestGIFFrameCountLimit(t *testing.T) {
+	data := gifHeader(-1)
+	for range 5 {
+		data = concat(data, graphicControl, gifFrame(0))
+	}
+	data = concat(data, gifTrailer)
+
+	for limit, want := range map[int]int{0: 5, -1: 5, 1: 2, 3: 4, 4: 5, 5: 5, 6: 5} {
+		if got := gifFrameCount(data, limit); got != want {
+			t.Errorf("limit %d: got %d frames, want %d", limit, got, want)
+		}
+	}
+}
+
+// TestInspectImage checks InspectImage on a GIF encoded by image/gif, with local color
+// tables and disposal methods, and on a malformed image.
+func TestInspectImage(t *testing.T) {
+	g := &gif.GIF{}
+	for i := range 4 {
+		palette := color.Palette{color.Black, color.RGBA{uint8(60 * i), 0, 0, 255}}
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 30, 20), palette))
+		g.Delay = append(g.Delay, 10)
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := InspectImage(buf.Bytes(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ImageInfo{Format: "gif", Width: 30, Height: 20, Frames: 4}); info != want {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+	if info, _ := InspectImage(buf.Bytes(), 2); info.Frames != 3 {
+		t.Errorf("with a limit of 2 frames, got %d frames, want 3", info.Frames)
+	}
+	if _, err := InspectImage([]byte("not an image"), 0); !errors.Is(err, image.ErrFormat) {
+		t.Errorf("got %v, want image.ErrFormat", err)
+	}
+}
+
+// TestLimitsCheck checks every limit at its exact value and one past it, with Downscale
+// on and off.
+func TestLimitsCheck(t *testing.T) {
+	limits := Limits{MaxWidth: 400, MaxHeight: 300, MaxPixels: 1_000_000, MaxFrames: 10}
+	tests := []struct {
+		name      string
+		info      ImageInfo
+		size      image.Point // with Downscale
+		limit     string      // of the error, with Downscale off
+		downLimit string      // of the error, with Downscale on
+	}{
+		{"within", ImageInfo{Width: 100, Height: 50, Frames: 1}, image.Point{}, "", ""},
+		{"exact width and height", ImageInfo{Width: 400, Height: 300, Frames: 1}, image.Point{}, "", ""},
+		{"one pixel too wide", ImageInfo{Width: 401, Height: 300, Frames: 1}, image.Pt(400, 299), "width", ""},
+		{"one pixel too tall", ImageInfo{Width: 400, Height: 301, Frames: 1}, image.Pt(399, 300), "height", ""},
+		{"too wide and tall", ImageInfo{Width: 800, Height: 900, Frames: 1}, image.Pt(267, 300), "width", ""},
+		{"thin", ImageInfo{Width: 5000, Height: 1, Frames: 1}, image.Pt(400, 1), "width", ""},
+		{"exact frames", ImageInfo{Width: 100, Height: 100, Frames: 10}, image.Point{}, "", ""},
+		{"one frame too many", ImageInfo{Width: 1, Height: 1, Frames: 11}, image.Point{}, "frames", "frames"},
+		{"exact pixels", ImageInfo{Width: 400, Height: 250, Frames: 10}, image.Point{}, "", ""},
+		{"one pixel too many", ImageInfo{Width: 1_000_001, Height: 1, Frames: 1}, image.Point{}, "megapixels", "megapixels"},
+		// Pixels are counted before scaling, since the image is decoded at full size.
+		{"too many pixels to scale", ImageInfo{Width: 1001, Height: 1000, Frames: 1}, image.Point{}, "megapixels", "megapixels"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, downscale := range []bool{false, true} {
+				l := limits
+				l.Downscale = downscale
+				wantLimit, wantSize := tc.limit, image.Point{}
+				if downscale {
+					wantLimit, wantSize = tc.downLimit, tc.size
+				}
+
+				size, err := l.Check(tc.info)
+				var limitErr *LimitError
+				switch {
+				case wantLimit == "" && err != nil:
+					t.Errorf("downscale %v: got error %v", downscale, err)
+				case wantLimit != "" && (!errors.As(err, &limitErr) || limitErr.Limit != wantLimit):
+					t.Errorf("downscale %v: got error %v, want a %s LimitError", downscale, err, wantLimit)
+				case size != wantSize:
+					t.Errorf("downscale %v: got size %v, want %v", downscale, size, wantSize)
+				}
+			}
+		})
+	}
+
+	if _, err := (Limits{}).Check(ImageInfo{Width: 1 << 20, Height: 1 << 20, Frames: 1 << 10}); err != nil {
+		t.Errorf("zero limits: got %v", err)
+	}
+}
+
+// TestFitSize checks that scaled sizes keep the aspect ratio, reach the limits exactly
+// and never fall to zero.
+func TestFitSize(t *testing.T) {
+	tests := []struct {
+		width, height, maxWidth, maxHeight int
+		want                               image.Point
+	}{
+		{400, 300, 400, 300, image.Pt(400, 300)},
+		{800, 600, 400, 300, image.Pt(400, 300)},
+		{800, 600, 400, 0, image.Pt(400, 300)},
+		{800, 600, 0, 300, image.Pt(400, 300)},
+		{1000, 200, 400, 300, image.Pt(400, 80)},
+		{200, 1000, 400, 300, image.Pt(60, 300)},
+		{401, 300, 400, 300, image.Pt(400, 299)},
+		{10000, 1, 400, 300, image.Pt(400, 1)},
+		{1, 10000, 400, 300, image.Pt(1, 300)},
+		{100, 100, 400, 300, image.Pt(100, 100)},
+	}
+	for _, tc := range tests {
+		if got := fitSize(tc.width, tc.height, tc.maxWidth, tc.maxHeight); got != tc.want {
+			t.Errorf("fitSize(%d, %d, %d, %d) = %v, want %v", tc.width, tc.height, tc.maxWidth, tc.maxHeight, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"neko-love/filters"
+	"strconv"
+	"strings"
+
+	"github.com/chai2010/webp"
+)
+
+// DefaultJPEGQuality is the JPEG quality used when the client does not ask for one.
+const DefaultJPEGQuality = 90
+
+// DefaultWebPQuality is the WebP quality used when the client does not ask for one and
+// NegotiateOutput picks lossy WebP.
+const DefaultWebPQuality = 80
+
+// outputFormats lists the supported output formats with their MIME type,
+// in the order they are preferred when negotiation leaves a tie.
+var outputFormats = []struct {
+	name string
+	mime string
+}{
+	{"png", "image/png"},
+	{"jpeg", "image/jpeg"},
+	{"webp", "image/webp"},
+	{"gif", "image/gif"},
+}
+
+// ErrNotAcceptable is returned by NegotiateOutput when the Accept header rules out
+// every supported output format.
+var ErrNotAcceptable = errors.New("none of the supported image formats is acceptable")
+
+// OutputOptions describes how a filtered image is encoded in the response.
+type OutputOptions struct {
+	// Format is one of "png", "jpeg", "webp" or "gif".
+	Format string
+	// Quality is the lossy quality from 1 to 100. Zero selects the format default:
+	// quality 90 for JPEG and lossless compression for WebP. It is ignored for PNG and GIF.
+	// NegotiateOutput sets it to DefaultWebPQuality when lossless WebP is not wanted.
+	Quality int
+	// GIF controls the palette and dithering of GIF output.
+	GIF GIFOptions
+}
+
+// ContentType returns the MIME type of the output format.
+func (o OutputOptions) ContentType() string {
+	for _, f := range outputFormats {
+		if f.name == o.Format {
+			return f.mime
+		}
+	}
+	return "image/png"
+}
+
+// QualityLabel returns the effective quality as reported to clients: the numeric
+// quality for lossy encodings, "palette" for GIF and "lossless" otherwise.
+func (o OutputOptions) QualityLabel() string {
+	switch {
+	case o.Format == "jpeg" && o.Quality == 0:
+		return strconv.Itoa(DefaultJPEGQuality)
+	case o.Format == "jpeg" || (o.Format == "webp" && o.Quality > 0):
+		return strconv.Itoa(o.Quality)
+	case o.Format == "gif":
+		return "palette"
+	default:
+		return "lossless"
+	}
+}
+
+// OutputError reports an invalid output option given by the client.
+type OutputError struct {
+	Param  string
+	Value  string
+	Reason string
+}
+
+func (e *OutputError) Error() string {
+	return fmt.Sprintf("invalid value %q for parameter '%s': %s", e.Value, e.Param, e.Reason)
+}
+
+// NegotiateOutput chooses the output format and quality of a filtered image.
+// An explicit format always wins; otherwise the supported format with the highest
+// weight in the Accept header is used, the input format winning ties so images keep
+// their format by default. Animated inputs stay GIF whenever the client accepts GIF,
+// so animations are not silently flattened to their first frame.
+//
+// Without a quality, WebP output is lossy at DefaultWebPQuality when it is made from a
+// JPEG input or chosen from the Accept header in place of another format, since lossless
+// WebP of a photo is larger than the photo itself. It is lossless otherwise.
+//
+// Parameters:
+//   - format: the "format" query parameter, empty when not given.
+//   - quality: the "quality" query parameter, empty when not given.
+//   - accept: the Accept request header, empty when not given.
+//   - inputFormat: the format name of the source image, as returned by image.DecodeConfig.
+//   - animated: whether the source image is an animated GIF.
+//
+// Returns an *OutputError for invalid parameters, or ErrNotAcceptable when the Accept
+// header excludes every supported format.
+func NegotiateOutput(format, quality, accept, inputFormat string, animated bool) (OutputOptions, error) {
+	opts := OutputOptions{GIF: DefaultGIFOptions()}
+
+	if quality != "" {
+		q, err := strconv.Atoi(quality)
+		if err != nil || q < 1 || q > 100 {
+			return opts, &OutputError{Param: "quality", Value: quality, Reason: "must be an integer between 1 and 100"}
+		}
+		opts.Quality = q
+	}
+
+	if format != "" {
+		format = strings.ToLower(format)
+		if format == "jpg" {
+			format = "jpeg"
+		}
+		if !supportedFormat(format) {
+			return opts, &OutputError{Param: "format", Value: format, Reason: "must be one of png, jpeg, webp or gif"}
+		}
+		opts.Format = format
+		if format == "webp" && opts.Quality == 0 && inputFormat == "jpeg" {
+			opts.Quality = DefaultWebPQuality
+		}
+		return opts, nil
+	}
+
+	if !supportedFormat(inputFormat) {
+		inputFormat = "png"
+	}
+
+	ranges := parseAccept(accept)
+	if animated && acceptWeight(ranges, "image/gif") > 0 {
+		opts.Format = "gif"
+		return opts, nil
+	}
+
+	best, bestWeight := inputFormat, acceptWeight(ranges, mimeOf(inputFormat))
+	for _, f := range outputFormats {
+		if w := acceptWeight(ranges, f.mime); w > bestWeight {
+			best, bestWeight = f.name, w
+		}
+	}
+	if bestWeight <= 0 {
+		return opts, ErrNotAcceptable
+	}
+
+	opts.Format = best
+	if best == "webp" && opts.Quality == 0 && inputFormat != "webp" {
+		opts.Quality = DefaultWebPQuality
+	}
+	return opts, nil
+}
+
+// Encode writes img to w in the format described by opts.
+// GIF output is quantized with opts.GIF, like the frames of an animation.
+func Encode(w io.Writer, img image.Image, opts OutputOptions) error {
+	switch opts.Format {
+	case "jpeg":
+		quality := opts.Quality
+		if quality == 0 {
+			quality = DefaultJPEGQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "webp":
+		if opts.Quality == 0 {
+			return webp.Encode(w, img, &webp.Options{Lossless: true})
+		}
+		return webp.Encode(w, img, &webp.Options{Quality: float32(opts.Quality)})
+	case "gif":
+		rgba := toRGBA(img)
+		paletted := quantizeFrame(rgba, nil, opts.GIF.Dither)
+		defer filters.ReleasePaletted(paletted)
+		if rgba != img {
+			filters.ReleaseRGBA(rgba)
+		}
+		return gif.Encode(w, paletted, nil)
+	default:
+		return png.Encode(w, img)
+	}
+}
+
+// acceptRange is a single media range of an Accept header with its weight.
+type acceptRange struct {
+	mime   string
+	weight float64
+}
+
+// parseAccept parses an Accept header into its media ranges. An empty header
+// is treated as "*/*", accepting every format.
+func parseAccept(accept string) []acceptRange {
+	if strings.TrimSpace(accept) == "" {
+		return []acceptRange{{mime: "*/*", weight: 1}}
+	}
+
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		r := acceptRange{mime: strings.ToLower(strings.TrimSpace(fields[0])), weight: 1}
+		for _, param := range fields[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if key == "q" {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					r.weight = q
+				}
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// acceptWeight returns the weight given to mime by the most specific matching
+// media range, or 0 when no range matches.
+func acceptWeight(ranges []acceptRange, mime string) float64 {
+	weight, specificity := 0.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.mime == mime:
+			s = 2
+		case r.mime == "image/*":
+			s = 1
+		case r.mime == "*/*":
+			s = 0
+		}
+		if s > specificity {
+			weight, specificity = r.weight, s
+		}
+	}
+	return weight
+}
+
+// supportedFormat reports whether name is a supported output format.
+func supportedFormat(name string) bool {
+	for _, f := range outputFormats {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// mimeOf returns the MIME type of the named output format.
+func mimeOf(name string) string {
+	return OutputOptions{Format: name}.ContentType()
+}
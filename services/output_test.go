@@ -0,0 +1,105 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestNegotiateOutput checks the format, quality and quality label chosen from the query
+// parameters, the Accept header and the input.
+func TestNegotiateOutput(t *testing.T) {
+	tests := []struct {
+		name                   string
+		format, quality        string
+		accept, input          string
+		animated               bool
+		wantFormat             string
+		wantQuality            int
+		wantLabel, contentType string
+	}{
+		// Explicit format and quality.
+		{"input format kept", "", "", "", "png", false, "png", 0, "lossless", "image/png"},
+		{"jpeg input kept", "", "", "", "jpeg", false, "jpeg", 0, "90", "image/jpeg"},
+		{"unsupported input", "", "", "", "bmp", false, "png", 0, "lossless", "image/png"},
+		{"explicit format", "JPG", "", "image/png", "png", false, "jpeg", 0, "90", "image/jpeg"},
+		{"explicit quality", "jpeg", "75", "", "png", false, "jpeg", 75, "75", "image/jpeg"},
+		{"explicit webp", "webp", "", "", "png", false, "webp", 0, "lossless", "image/webp"},
+		{"explicit webp quality", "webp", "60", "", "png", false, "webp", 60, "60", "image/webp"},
+		{"explicit webp of a jpeg", "webp", "", "", "jpeg", false, "webp", DefaultWebPQuality, "80", "image/webp"},
+		{"explicit webp of a jpeg with quality", "webp", "95", "", "jpeg", false, "webp", 95, "95", "image/webp"},
+		{"explicit webp of a webp", "webp", "", "", "webp", false, "webp", 0, "lossless", "image/webp"},
+		{"explicit format of an animation", "png", "", "", "gif", true, "png", 0, "lossless", "image/png"},
+		{"gif", "gif", "50", "", "png", false, "gif", 50, "palette", "image/gif"},
+
+		// Accept header.
+		{"accepted webp", "", "", "image/webp,image/*;q=0.8", "png", false, "webp", DefaultWebPQuality, "80", "image/webp"},
+		{"accepted webp with quality", "", "40", "image/webp,image/*;q=0.8", "jpeg", false, "webp", 40, "40", "image/webp"},
+		{"accepted webp of a webp", "", "", "image/webp", "webp", false, "webp", 0, "lossless", "image/webp"},
+		{"accepted jpeg", "", "", "image/jpeg", "png", false, "jpeg", 0, "90", "image/jpeg"},
+		{"input format accepted", "", "", "image/avif,image/webp;q=0.5,image/png;q=0.5", "png", false, "png", 0, "lossless", "image/png"},
+		{"wildcard", "", "", "*/*", "webp", false, "webp", 0, "lossless", "image/webp"},
+		{"specific range over wildcard", "", "", "image/*,image/png;q=0.1", "png", false, "jpeg", 0, "90", "image/jpeg"},
+		{"animation stays gif", "", "", "image/webp,image/gif;q=0.1", "gif", true, "gif", 0, "palette", "image/gif"},
+		{"animation without gif", "", "", "image/webp,image/gif;q=0", "gif", true, "webp", DefaultWebPQuality, "80", "image/webp"},
+		{"still gif", "", "", "image/webp,image/gif;q=0.1", "gif", false, "webp", DefaultWebPQuality, "80", "image/webp"},
+
+		// Ties between the weights of the Accept header: the input format wins, then
+		// the first of png, jpeg, webp and gif.
+		{"tie with the input", "", "", "image/webp,image/gif", "gif", false, "gif", 0, "palette", "image/gif"},
+		{"tie with a wildcard input", "", "", "image/*", "jpeg", false, "jpeg", 0, "90", "image/jpeg"},
+		{"tie without the input", "", "", "image/gif;q=0.5,image/webp;q=0.5,image/jpeg;q=0.1", "png", false, "webp", DefaultWebPQuality, "80", "image/webp"},
+		{"tie in preference order", "", "", "image/gif,image/jpeg,image/webp", "png", false, "jpeg", 0, "90", "image/jpeg"},
+		{"unsupported input tie", "", "", "image/jpeg,image/png", "bmp", false, "png", 0, "lossless", "image/png"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts, err := NegotiateOutput(tc.format, tc.quality, tc.accept, tc.input, tc.animated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.Format != tc.wantFormat || opts.Quality != tc.wantQuality {
+				t.Errorf("got %s at quality %d, want %s at quality %d", opts.Format, opts.Quality, tc.wantFormat, tc.wantQuality)
+			}
+			if label := opts.QualityLabel(); label != tc.wantLabel {
+				t.Errorf("got quality label %q, want %q", label, tc.wantLabel)
+			}
+			if contentType := opts.ContentType(); contentType != tc.contentType {
+				t.Errorf("got content type %q, want %q", contentType, tc.contentType)
+			}
+			if def := DefaultGIFOptions(); opts.GIF.Palette != def.Palette || opts.GIF.Dither != def.Dither {
+				t.Errorf("got GIF options %+v, want the defaults", opts.GIF)
+			}
+		})
+	}
+}
+
+// TestNegotiateOutputErrors checks the invalid parameters and the Accept headers ruling out
+// every supported format.
+func TestNegotiateOutputErrors(t *testing.T) {
+	for _, tc := range []struct {
+		format, quality, accept string
+		param                   string // of the *OutputError, empty for ErrNotAcceptable
+	}{
+		{"bmp", "", "", "format"},
+		{"", "0", "", "quality"},
+		{"", "101", "", "quality"},
+		{"jpeg", "high", "", "quality"},
+		{"", "", "text/html", ""},
+		{"", "", "image/*;q=0", ""},
+		{"", "", "image/avif", ""},
+	} {
+		_, err := NegotiateOutput(tc.format, tc.quality, tc.accept, "png", false)
+		var outputErr *OutputError
+		switch {
+		case tc.param == "" && !errors.Is(err, ErrNotAcceptable):
+			t.Errorf("%+v: got %v, want ErrNotAcceptable", tc, err)
+		case tc.param != "" && (!errors.As(err, &outputErr) || outputErr.Param != tc.param):
+			t.Errorf("%+v: got %v, want an *OutputError for %s", tc, err, tc.param)
+		}
+	}
+
+	// An explicit format is not held to the Accept header.
+	if opts, err := NegotiateOutput("gif", "", "image/png", "png", false); err != nil || opts.Format != "gif" {
+		t.Errorf("explicit format: got %+v, %v", opts, err)
+	}
+}
@@ -0,0 +1,519 @@
+package services
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"neko-love/filters"
+	"sort"
+)
+
+// PaletteMode selects how the color palettes of a GIF output are built.
+type PaletteMode string
+
+// DitherMode selects the dithering applied when mapping pixels to a palette.
+type DitherMode string
+
+const (
+	// PalettePerFrame builds an optimal palette for every frame.
+	PalettePerFrame PaletteMode = "frame"
+	// PaletteGlobal builds one palette shared by every frame of the animation.
+	PaletteGlobal PaletteMode = "global"
+
+	// DitherFloydSteinberg diffuses the quantization error to neighbouring pixels.
+	DitherFloydSteinberg DitherMode = "floyd"
+	// DitherOrdered offsets pixels with a Bayer threshold matrix before mapping them.
+	DitherOrdered DitherMode = "ordered"
+	// DitherNone maps every pixel to its nearest palette color.
+	DitherNone DitherMode = "none"
+)
+
+// maxPaletteColors is the number of opaque colors in a GIF palette, index 0
+// being reserved for transparency.
+const maxPaletteColors = 255
+
+// GIFOptions controls how GIF output is produced.
+type GIFOptions struct {
+	Palette PaletteMode
+	Dither  DitherMode
+	// Workers is the number of frames processed concurrently. Zero uses one
+	// worker per available CPU.
+	Workers int
+	// Size, when not zero, is the size frames are scaled down to before being
+	// filtered, for animations exceeding the Limits (see Limits.Downscale).
+	Size image.Point
+	// Progress, when not nil, is called every time one more frame is filtered. It is
+	// called from the workers, concurrently.
+	Progress func()
+}
+
+// DefaultGIFOptions returns the quantization used when the client does not choose one:
+// a palette per frame with Floyd-Steinberg dithering.
+func DefaultGIFOptions() GIFOptions {
+	return GIFOptions{Palette: PalettePerFrame, Dither: DitherFloydSteinberg}
+}
+
+// ParseGIFOptions parses the "palette" and "dither" query parameters, using the
+// defaults of DefaultGIFOptions for empty values. It returns an *OutputError naming
+// the parameter for unknown values.
+func ParseGIFOptions(palette, dither string) (GIFOptions, error) {
+	opts := DefaultGIFOptions()
+
+	switch PaletteMode(palette) {
+	case "":
+	case PalettePerFrame, PaletteGlobal:
+		opts.Palette = PaletteMode(palette)
+	default:
+		return opts, &OutputError{Param: "palette", Value: palette, Reason: "must be one of frame or global"}
+	}
+
+	switch DitherMode(dither) {
+	case "":
+	case DitherFloydSteinberg, DitherOrdered, DitherNone:
+		opts.Dither = DitherMode(dither)
+	default:
+		return opts, &OutputError{Param: "dither", Value: dither, Reason: "must be one of floyd, ordered or none"}
+	}
+
+	return opts, nil
+}
+
+// histogram accumulates the opaque colors of one or more images into 15-bit buckets,
+// keeping the exact average color of every bucket. As long as there are no more
+// distinct colors than a palette holds, it keeps them as well, so images with few
+// colors are quantized without loss even when some of their colors share a bucket.
+type histogram struct {
+	count   [1 << 15]uint32
+	r, g, b [1 << 15]uint64
+
+	// colors are the distinct colors added, in order of first appearance, until
+	// there are more than maxPaletteColors of them, when tooMany is set instead.
+	// The colors of every bucket are chained, most recently seen first: heads
+	// holds 1 + the index in colors of the first one, and next that of the one
+	// after every color, 0 ending the chain.
+	colors  [][3]uint8
+	next    []uint8
+	heads   [1 << 15]uint8
+	tooMany bool
+}
+
+// add accumulates the opaque pixels of img. Pixels that are not fully opaque are
+// skipped since they are written with the transparent index.
+func (h *histogram) add(img *image.RGBA) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := img.PixOffset(b.Min.X, y)
+		for x := b.Min.X; x < b.Max.X; x, i = x+1, i+4 {
+			if img.Pix[i+3] != 255 {
+				continue
+			}
+			r, g, b := img.Pix[i], img.Pix[i+1], img.Pix[i+2]
+			k := colorKey(r, g, b)
+			h.count[k]++
+			h.r[k] += uint64(r)
+			h.g[k] += uint64(g)
+			h.b[k] += uint64(b)
+
+			if c := [3]uint8{r, g, b}; !h.tooMany {
+				if head := h.heads[k]; head == 0 || h.colors[head-1] != c {
+					h.addColor(k, c)
+				}
+			}
+		}
+	}
+}
+
+// addColor records c, of bucket k, among the distinct colors of the histogram, moving
+// it to the front of its bucket when already known, and gives up on the colors once
+// there are more than a palette holds.
+func (h *histogram) addColor(k int, c [3]uint8) {
+	for prev, i := uint8(0), h.heads[k]; i != 0; prev, i = i, h.next[i-1] {
+		if h.colors[i-1] == c {
+			if prev != 0 {
+				h.next[prev-1] = h.next[i-1]
+				h.next[i-1] = h.heads[k]
+				h.heads[k] = i
+			}
+			return
+		}
+	}
+
+	if len(h.colors) == maxPaletteColors {
+		h.colors, h.next, h.tooMany = nil, nil, true
+		return
+	}
+	h.colors = append(h.colors, c)
+	h.next = append(h.next, h.heads[k])
+	h.heads[k] = uint8(len(h.colors))
+}
+
+// histEntry is a populated histogram bucket.
+type histEntry struct {
+	c     [3]uint8
+	count uint32
+}
+
+// palette builds a palette with a transparent entry at index 0 followed by up to
+// 255 colors: the colors added themselves when they fit, or else colors chosen by
+// median cut over the histogram.
+func (h *histogram) palette() color.Palette {
+	if !h.tooMany && len(h.colors) > 0 {
+		p := make(color.Palette, 0, len(h.colors)+1)
+		p = append(p, color.RGBA{0, 0, 0, 0})
+		for _, c := range h.colors {
+			p = append(p, color.RGBA{c[0], c[1], c[2], 255})
+		}
+		return p
+	}
+
+	var entries []histEntry
+	for k, n := range h.count {
+		if n == 0 {
+			continue
+		}
+		entries = append(entries, histEntry{
+			c:     [3]uint8{uint8(h.r[k] / uint64(n)), uint8(h.g[k] / uint64(n)), uint8(h.b[k] / uint64(n))},
+			count: n,
+		})
+	}
+
+	p := color.Palette{color.RGBA{0, 0, 0, 0}}
+	for _, box := range medianCut(entries, maxPaletteColors) {
+		p = append(p, box.average())
+	}
+	if len(p) == 1 {
+		// Fully transparent input: keep a valid palette with a single opaque color.
+		p = append(p, color.RGBA{0, 0, 0, 255})
+	}
+	return p
+}
+
+// colorBox is a set of histogram entries delimited during median cut.
+type colorBox struct {
+	entries []histEntry
+	count   uint64
+}
+
+// newColorBox returns a box holding entries.
+func newColorBox(entries []histEntry) colorBox {
+	box := colorBox{entries: entries}
+	for _, e := range entries {
+		box.count += uint64(e.count)
+	}
+	return box
+}
+
+// widestChannel returns the color channel with the largest range in the box and that range.
+func (b colorBox) widestChannel() (int, int) {
+	lo := [3]uint8{255, 255, 255}
+	hi := [3]uint8{}
+	for _, e := range b.entries {
+		for ch := 0; ch < 3; ch++ {
+			lo[ch] = min(lo[ch], e.c[ch])
+			hi[ch] = max(hi[ch], e.c[ch])
+		}
+	}
+
+	widest, span := 0, -1
+	for ch := 0; ch < 3; ch++ {
+		if s := int(hi[ch]) - int(lo[ch]); s > span {
+			widest, span = ch, s
+		}
+	}
+	return widest, span
+}
+
+// average returns the count-weighted average color of the box.
+func (b colorBox) average() color.RGBA {
+	var sum [3]uint64
+	for _, e := range b.entries {
+		for ch := 0; ch < 3; ch++ {
+			sum[ch] += uint64(e.c[ch]) * uint64(e.count)
+		}
+	}
+	return color.RGBA{
+		R: uint8(sum[0] / b.count),
+		G: uint8(sum[1] / b.count),
+		B: uint8(sum[2] / b.count),
+		A: 255,
+	}
+}
+
+// medianCut splits the entries into at most n boxes. It repeatedly splits the box
+// with the largest population times color range, at the population median of its
+// widest channel.
+func medianCut(entries []histEntry, n int) []colorBox {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	boxes := []colorBox{newColorBox(entries)}
+	for len(boxes) < n {
+		best, bestScore := -1, uint64(0)
+		for i, box := range boxes {
+			if len(box.entries) < 2 {
+				continue
+			}
+			_, span := box.widestChannel()
+			if score := box.count * uint64(span); score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		box := boxes[best]
+		ch, _ := box.widestChannel()
+		sort.Slice(box.entries, func(i, j int) bool { return box.entries[i].c[ch] < box.entries[j].c[ch] })
+
+		var acc uint64
+		split := 1
+		for i, e := range box.entries[:len(box.entries)-1] {
+			acc += uint64(e.count)
+			split = i + 1
+			if acc*2 >= box.count {
+				break
+			}
+		}
+
+		boxes[best] = newColorBox(box.entries[:split])
+		boxes = append(boxes, newColorBox(box.entries[split:]))
+	}
+
+	return boxes
+}
+
+// paletteMapper finds the nearest opaque palette entry of a color, caching the
+// result per 15-bit color bucket.
+type paletteMapper struct {
+	palette color.Palette
+	rgb     [][3]int32
+	// cache holds the index found for every bucket, or -1 when there is none yet.
+	// The buckets holding several palette colors, which the cache cannot tell apart,
+	// are marked with -2-i instead, i indexing their entry in shared.
+	cache  [1 << 15]int16
+	shared []sharedBucket
+}
+
+// sharedBucket is a bucket holding several palette colors: its colors, packed by
+// packColor, are matched exactly, and the others mapped to the cached nearest index,
+// when not -1.
+type sharedBucket struct {
+	colors  []uint32
+	indices []uint8
+	nearest int16
+}
+
+// newPaletteMapper returns a mapper for p, whose index 0 is the transparent entry.
+func newPaletteMapper(p color.Palette) *paletteMapper {
+	m := &paletteMapper{palette: p, rgb: make([][3]int32, len(p))}
+	for i := range m.cache {
+		m.cache[i] = -1
+	}
+	// The first color of every bucket, plus one.
+	first := make(map[int]int, len(p))
+	for i, c := range p {
+		r, g, b, _ := c.RGBA()
+		m.rgb[i] = [3]int32{int32(r >> 8), int32(g >> 8), int32(b >> 8)}
+		if i == 0 {
+			continue
+		}
+		k := colorKey(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+		switch j := first[k]; {
+		case j == 0:
+			first[k] = i + 1
+		case m.cache[k] == -1:
+			m.cache[k] = int16(-2 - len(m.shared))
+			m.shared = append(m.shared, sharedBucket{nearest: -1})
+			m.shared[len(m.shared)-1].add(m.rgb[j-1], j-1)
+			fallthrough
+		default:
+			m.shared[-2-m.cache[k]].add(m.rgb[i], i)
+		}
+	}
+	return m
+}
+
+// add adds the palette color c, of index i, to the bucket.
+func (b *sharedBucket) add(c [3]int32, i int) {
+	b.colors = append(b.colors, packColor(uint8(c[0]), uint8(c[1]), uint8(c[2])))
+	b.indices = append(b.indices, uint8(i))
+}
+
+// index returns the palette index of the opaque color nearest to (r, g, b).
+func (m *paletteMapper) index(r, g, b uint8) uint8 {
+	k := colorKey(r, g, b)
+	idx := m.cache[k]
+	if idx >= 0 {
+		return uint8(idx)
+	}
+	var bucket *sharedBucket
+	if idx < -1 {
+		bucket = &m.shared[-2-idx]
+		packed := packColor(r, g, b)
+		for j, c := range bucket.colors {
+			if c == packed {
+				return bucket.indices[j]
+			}
+		}
+		if bucket.nearest >= 0 {
+			return uint8(bucket.nearest)
+		}
+	}
+
+	best, bestDist := 1, int32(1<<30)
+	for i := 1; i < len(m.rgb); i++ {
+		dr := m.rgb[i][0] - int32(r)
+		dg := m.rgb[i][1] - int32(g)
+		db := m.rgb[i][2] - int32(b)
+		if d := dr*dr + dg*dg + db*db; d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+
+	if bucket != nil {
+		bucket.nearest = int16(best)
+	} else {
+		m.cache[k] = int16(best)
+	}
+	return uint8(best)
+}
+
+// bayer4 is the 4x4 Bayer threshold matrix used for ordered dithering.
+var bayer4 = [4][4]int32{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// orderedSpread is the amplitude of the ordered dithering offsets.
+const orderedSpread = 32
+
+// quantize maps img onto palette p using the given dithering. Pixels that are not
+// fully opaque are written with the transparent index 0, which never receives or
+// spreads any dithering error.
+func quantize(img *image.RGBA, p color.Palette, dither DitherMode) *image.Paletted {
+	bounds := img.Bounds()
+	dst := filters.NewPaletted(bounds, p)
+	mapper := newPaletteMapper(p)
+	width := bounds.Dx()
+
+	// Floyd-Steinberg error buffers for the current and next row, with one
+	// pixel of padding on each side. Errors are stored scaled by 16.
+	var curr, next [][3]int32
+	if dither == DitherFloydSteinberg {
+		curr = make([][3]int32, width+2)
+		next = make([][3]int32, width+2)
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		si := img.PixOffset(bounds.Min.X, y)
+		di := dst.PixOffset(bounds.Min.X, y)
+
+		for x := 0; x < width; x, si, di = x+1, si+4, di+1 {
+			if img.Pix[si+3] != 255 {
+				dst.Pix[di] = 0
+				continue
+			}
+
+			r, g, b := int32(img.Pix[si]), int32(img.Pix[si+1]), int32(img.Pix[si+2])
+			switch dither {
+			case DitherFloydSteinberg:
+				r += curr[x+1][0] / 16
+				g += curr[x+1][1] / 16
+				b += curr[x+1][2] / 16
+			case DitherOrdered:
+				offset := (bayer4[(y-bounds.Min.Y)&3][x&3]*2 - 15) * orderedSpread / 32
+				r, g, b = r+offset, g+offset, b+offset
+			}
+			r, g, b = clampChannel(r), clampChannel(g), clampChannel(b)
+
+			idx := mapper.index(uint8(r), uint8(g), uint8(b))
+			dst.Pix[di] = idx
+
+			if dither == DitherFloydSteinberg {
+				pc := mapper.rgb[idx]
+				e := [3]int32{r - pc[0], g - pc[1], b - pc[2]}
+				for ch := 0; ch < 3; ch++ {
+					curr[x+2][ch] += e[ch] * 7
+					next[x][ch] += e[ch] * 3
+					next[x+1][ch] += e[ch] * 5
+					next[x+2][ch] += e[ch]
+				}
+			}
+		}
+
+		if dither == DitherFloydSteinberg {
+			curr, next = next, curr
+			clear(next)
+		}
+	}
+
+	return dst
+}
+
+// quantizeFrames converts the frames to paletted images according to opts, using
+// either one palette per frame or a single palette built from every frame, which is
+// returned as well, nil otherwise.
+// Frames are quantized concurrently by up to opts.Workers goroutines, until ctx is done.
+func quantizeFrames(ctx context.Context, frames []*image.RGBA, opts GIFOptions) ([]*image.Paletted, color.Palette, error) {
+	var shared color.Palette
+	if opts.Palette == PaletteGlobal {
+		h := new(histogram)
+		for _, f := range frames {
+			h.add(f)
+		}
+		shared = h.palette()
+	}
+
+	result := make([]*image.Paletted, len(frames))
+	err := parallelFor(ctx, len(frames), opts.Workers, func(i int) error {
+		result[i] = quantizeFrame(frames[i], shared, opts.Dither)
+		return nil
+	})
+	return result, shared, err
+}
+
+// quantizeFrame quantizes a single frame onto p, or onto its own palette when p is nil.
+func quantizeFrame(frame *image.RGBA, p color.Palette, dither DitherMode) *image.Paletted {
+	if p == nil {
+		h := new(histogram)
+		h.add(frame)
+		p = h.palette()
+	}
+	return quantize(frame, p, dither)
+}
+
+// toRGBA returns img as an *image.RGBA, converting it into a pooled buffer only when needed.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	rgba := filters.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+// packColor returns a color packed in an integer.
+func packColor(r, g, b uint8) uint32 {
+	return uint32(r)<<16 | uint32(g)<<8 | uint32(b)
+}
+
+// colorKey returns the 15-bit bucket of a color, keeping 5 bits per channel.
+func colorKey(r, g, b uint8) int {
+	return int(r>>3)<<10 | int(g>>3)<<5 | int(b>>3)
+}
+
+// clampChannel limits v to the range of a color channel.
+func clampChannel(v int32) int32 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return v
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math/rand/v2"
+	"testing"
+)
+
+// colorfulImage returns an image of the given size whose pixels take n distinct opaque
+// colors, some of them close enough to fall into the same histogram bucket, except for
+// its top-left pixel, which is transparent. The image must have several pixels of each
+// color.
+func colorfulImage(width, height, n int, seed uint64) *image.RGBA {
+	rng := rand.New(rand.NewPCG(seed, 0))
+	colors := make([]color.RGBA, 0, n)
+	seen := make(map[color.RGBA]bool)
+	for len(colors) < n {
+		c := color.RGBA{uint8(rng.IntN(256)), uint8(rng.IntN(256)), uint8(rng.IntN(256)), 255}
+		if len(colors)%3 == 1 {
+			// A neighbour of the previous color, in the same bucket.
+			prev := colors[len(colors)-1]
+			c = color.RGBA{prev.R ^ 1, prev.G, prev.B ^ 2, 255}
+		}
+		if !seen[c] {
+			seen[c] = true
+			colors = append(colors, c)
+		}
+	}
+
+	// Every color is used, in random places.
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i, j := range rng.Perm(width * height) {
+		img.SetRGBA(j%width, j/width, colors[i%n])
+	}
+	img.SetRGBA(0, 0, color.RGBA{})
+	return img
+}
+
+// checkPalette checks that p holds at most 256 entries, the first one transparent and
+// the others opaque.
+func checkPalette(t *testing.T, p color.Palette) {
+	t.Helper()
+	if len(p) > 256 {
+		t.Fatalf("palette has %d entries", len(p))
+	}
+	if _, _, _, a := p[0].RGBA(); a != 0 {
+		t.Fatalf("palette index 0 is %v, want transparent", p[0])
+	}
+	for i, c := range p[1:] {
+		if _, _, _, a := c.RGBA(); a != 0xffff {
+			t.Fatalf("palette index %d is %v, want an opaque color", i+1, c)
+		}
+	}
+}
+
+// TestQuantizePalette checks the palettes built for images with more colors than a GIF
+// palette holds, with every dithering.
+func TestQuantizePalette(t *testing.T) {
+	img := colorfulImage(64, 64, 1000, 1)
+	for _, dither := range []DitherMode{DitherNone, DitherOrdered, DitherFloydSteinberg} {
+		t.Run(string(dither), func(t *testing.T) {
+			paletted := quantizeFrame(img, nil, dither)
+			p := paletted.Palette
+			checkPalette(t, p)
+			if len(p) != 256 {
+				t.Errorf("palette has %d entries, want all 256 used", len(p))
+			}
+			for i, idx := range paletted.Pix {
+				if int(idx) >= len(p) {
+					t.Fatalf("pixel %d has index %d, out of the palette", i, idx)
+				}
+				if transparent := img.Pix[4*i+3] != 255; transparent != (idx == 0) {
+					t.Fatalf("pixel %d has index %d, transparent %v", i, idx, transparent)
+				}
+			}
+		})
+	}
+
+	if got := (&histogram{}).palette(); len(got) != 2 {
+		t.Errorf("palette of a transparent image has %d entries, want 2", len(got))
+	}
+	if boxes := medianCut(nil, maxPaletteColors); boxes != nil {
+		t.Errorf("median cut of nothing gave %d boxes", len(boxes))
+	}
+}
+
+// TestQuantizeExact checks that images with no more colors than a GIF palette holds are
+// quantized without any loss, whichever the dithering.
+func TestQuantizeExact(t *testing.T) {
+	for _, n := range []int{1, 2, 17, maxPaletteColors} {
+		img := colorfulImage(40, 40, n, uint64(n))
+		for _, dither := range []DitherMode{DitherNone, DitherFloydSteinberg} {
+			paletted := quantizeFrame(img, nil, dither)
+			checkPalette(t, paletted.Palette)
+			if len(paletted.Palette) != n+1 {
+				t.Errorf("%d colors, %s: palette has %d entries, want %d", n, dither, len(paletted.Palette), n+1)
+			}
+			for y := range 40 {
+				for x := range 40 {
+					if got, want := paletted.At(x, y), img.RGBAAt(x, y); color.RGBAModel.Convert(got) != want {
+						t.Fatalf("%d colors, %s: pixel (%d, %d) is %v, want %v", n, dither, x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestQuantizeGlobalPalette checks that the frames of a global palette share it, and
+// that each frame of a per-frame palette gets its own.
+func TestQuantizeGlobalPalette(t *testing.T) {
+	frames := make([]*image.RGBA, 3)
+	for i := range frames {
+		frames[i] = colorfulImage(32, 32, 500, uint64(10+i))
+	}
+
+	paletted, shared, err := quantizeFrames(context.Background(), frames, GIFOptions{Palette: PaletteGlobal, Dither: DitherNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPalette(t, shared)
+	for i, frame := range paletted {
+		if &frame.Palette[0] != &shared[0] {
+			t.Errorf("frame %d does not use the global palette", i)
+		}
+	}
+
+	paletted, shared, err = quantizeFrames(context.Background(), frames, GIFOptions{Palette: PalettePerFrame, Dither: DitherNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared != nil {
+		t.Errorf("per-frame palettes returned a global palette of %d entries", len(shared))
+	}
+	for i, frame := range paletted {
+		checkPalette(t, frame.Palette)
+		if i > 0 && &frame.Palette[0] == &paletted[0].Palette[0] {
+			t.Errorf("frame %d shares the palette of the first frame", i)
+		}
+	}
+}
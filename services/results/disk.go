@@ -0,0 +1,212 @@
+package results
+
+import (
+	"container/list"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tempPrefix starts the names of the files being written, which are renamed to
+// their key once complete so a crash never leaves a truncated result behind.
+const tempPrefix = ".tmp-"
+
+// versionFile is the name of the file recording the version that wrote the results.
+const versionFile = "VERSION"
+
+// diskTier keeps results as files named after their key in a directory, bounded by
+// their total size. Recency only accounts for the reads and writes of the tier itself,
+// not for the hits served from memory. Files already in the directory are picked up
+// when it is opened, the most recently modified ones being evicted last.
+type diskTier struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // of *diskEntry, most recently used first
+	entries map[Key]*list.Element
+}
+
+type diskEntry struct {
+	key  Key
+	size int64
+}
+
+// openDisk creates dir if needed and indexes the results it holds, evicting the
+// oldest ones if they exceed maxSize. Leftover temporary files are removed, and so are
+// all the results when they were written by another version than the given one.
+func openDisk(dir string, maxSize int64, version string) (*diskTier, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	versionPath := filepath.Join(dir, versionFile)
+	previous, err := os.ReadFile(versionPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	stale := string(previous) != version
+
+	type file struct {
+		key     Key
+		size    int64
+		modTime int64
+	}
+	var found []file
+	removed := 0
+	for _, entry := range files {
+		if strings.HasPrefix(entry.Name(), tempPrefix) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		key, ok := parseKey(entry.Name())
+		if ok && stale {
+			os.Remove(filepath.Join(dir, entry.Name()))
+			removed++
+			continue
+		}
+		info, err := entry.Info()
+		if !ok || err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		found = append(found, file{key: key, size: info.Size(), modTime: info.ModTime().UnixNano()})
+	}
+	if stale {
+		if err := os.WriteFile(versionPath, []byte(version), 0o644); err != nil {
+			return nil, err
+		}
+		if removed > 0 {
+			log.Printf("Result cache on disk at %s: removed %d results written by another version", dir, removed)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime < found[j].modTime })
+
+	d := &diskTier{dir: dir, maxSize: maxSize, order: list.New(), entries: make(map[Key]*list.Element)}
+	for _, f := range found {
+		d.entries[f.key] = d.order.PushFront(&diskEntry{key: f.key, size: f.size})
+		d.size += f.size
+	}
+	d.mu.Lock()
+	d.evict()
+	d.mu.Unlock()
+
+	log.Printf("Result cache opened on disk at %s with %d results", dir, len(d.entries))
+	return d, nil
+}
+
+// get reads the result named by key from disk.
+func (d *diskTier) get(key Key) ([]byte, bool) {
+	d.mu.Lock()
+	elem, ok := d.entries[key]
+	if ok {
+		d.order.MoveToFront(elem)
+	}
+	d.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	body, err := os.ReadFile(d.path(key))
+	if err != nil {
+		// The file was evicted meanwhile, or removed behind our back.
+		d.mu.Lock()
+		d.remove(key)
+		d.mu.Unlock()
+		return nil, false
+	}
+	return body, true
+}
+
+// put writes body as the result named by key, then evicts the least recently used
+// results to stay within the size budget. Write failures are logged and the result
+// is simply not cached on disk.
+func (d *diskTier) put(key Key, body []byte) {
+	size := int64(len(body))
+	if size > d.maxSize {
+		return
+	}
+	d.mu.Lock()
+	_, ok := d.entries[key]
+	d.mu.Unlock()
+	if ok {
+		return
+	}
+
+	if err := d.write(key, body); err != nil {
+		log.Printf("Result cache: %v", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.entries[key]; ok {
+		return
+	}
+	d.entries[key] = d.order.PushFront(&diskEntry{key: key, size: size})
+	d.size += size
+	d.evict()
+}
+
+// write stores body in the file of key through a temporary file.
+func (d *diskTier) write(key Key, body []byte) error {
+	tmp, err := os.CreateTemp(d.dir, tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// evict removes the least recently used results until the tier fits in its budget.
+// d.mu must be held.
+func (d *diskTier) evict() {
+	for d.size > d.maxSize {
+		d.remove(d.order.Back().Value.(*diskEntry).key)
+	}
+}
+
+// remove deletes the result named by key from the index and from disk. d.mu must be held.
+func (d *diskTier) remove(key Key) {
+	elem, ok := d.entries[key]
+	if !ok {
+		return
+	}
+	d.order.Remove(elem)
+	delete(d.entries, key)
+	d.size -= elem.Value.(*diskEntry).size
+	os.Remove(d.path(key))
+}
+
+// path returns the file holding the result named by key.
+func (d *diskTier) path(key Key) string {
+	return filepath.Join(d.dir, key.String())
+}
+
+// parseKey parses a file name written by the disk tier back into its key.
+func parseKey(name string) (Key, bool) {
+	var key Key
+	if hex.DecodedLen(len(name)) != len(key) {
+		return key, false
+	}
+	_, err := hex.Decode(key[:], []byte(name))
+	return key, err == nil
+}
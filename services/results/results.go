@@ -0,0 +1,208 @@
+package results
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+
+	"neko-love/services/flight"
+)
+
+// Key identifies a rendered result by the content of its inputs: the bytes of the
+// source image and everything that affects the rendering, such as the pipeline and the
+// output options. Equal keys always name byte-identical results.
+type Key [sha256.Size]byte
+
+// NewKey returns the key of the result rendered from source with the given parts,
+// which describe the rendering. Parts are length-prefixed, so no two different lists
+// of parts hash alike.
+func NewKey(source []byte, parts ...string) Key {
+	h := sha256.New()
+	sum := sha256.Sum256(source)
+	h.Write(sum[:])
+
+	var size [8]byte
+	for _, part := range parts {
+		binary.BigEndian.PutUint64(size[:], uint64(len(part)))
+		h.Write(size[:])
+		h.Write([]byte(part))
+	}
+
+	var key Key
+	h.Sum(key[:0])
+	return key
+}
+
+// String returns the key in hexadecimal.
+func (k Key) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+// ETag returns the strong entity tag of the result named by the key.
+func (k Key) ETag() string {
+	return `"` + k.String()[:32] + `"`
+}
+
+// Options configures a Cache.
+type Options struct {
+	// MemorySize is the total size, in bytes, of the results kept in memory.
+	// Zero disables the memory tier.
+	MemorySize int64
+	// DiskDir is the directory of the on-disk tier. Empty disables it.
+	DiskDir string
+	// DiskSize is the total size, in bytes, of the results kept on disk.
+	DiskSize int64
+	// Version identifies the code rendering the results. When the disk tier was written
+	// by another version, the results it holds are removed on opening, since their keys,
+	// which include the version, can no longer be asked for.
+	Version string
+}
+
+// Cache keeps rendered results so identical requests are answered without filtering
+// the image again. Results live in memory, least recently used first out, and, when a
+// directory is configured, on disk, which holds more and survives restarts. Results
+// read from disk are brought back into memory.
+//
+// Cached bodies are shared between requests and must not be modified.
+type Cache struct {
+	mu      sync.Mutex
+	memory  *lru
+	disk    *diskTier
+	renders flight.Group[Key, []byte]
+}
+
+// Origin tells where the body returned by Cache.Render comes from.
+type Origin string
+
+const (
+	// Hit means the result was in the cache.
+	Hit Origin = "HIT"
+	// Miss means the result was rendered for the caller.
+	Miss Origin = "MISS"
+	// Shared means the result was rendered for a concurrent caller asking for the same key.
+	Shared Origin = "SHARED"
+)
+
+// New returns a cache configured by opts. It fails when the disk directory cannot
+// be created or read.
+func New(opts Options) (*Cache, error) {
+	c := &Cache{memory: newLRU(opts.MemorySize)}
+	if opts.DiskDir != "" {
+		disk, err := openDisk(opts.DiskDir, opts.DiskSize, opts.Version)
+		if err != nil {
+			return nil, err
+		}
+		c.disk = disk
+	}
+	return c, nil
+}
+
+// Get returns the body of the result named by key, if it is cached.
+func (c *Cache) Get(key Key) ([]byte, bool) {
+	c.mu.Lock()
+	body, ok := c.memory.get(key)
+	c.mu.Unlock()
+	if ok || c.disk == nil {
+		return body, ok
+	}
+
+	body, ok = c.disk.get(key)
+	if ok {
+		c.mu.Lock()
+		c.memory.add(key, body)
+		c.mu.Unlock()
+	}
+	return body, ok
+}
+
+// Render returns the result named by key, from the cache when it is there. Otherwise
+// render produces it and it is stored in the cache. Concurrent calls for the same key
+// share a single render, which keeps running when the ctx of a caller is done: that
+// caller returns ctx.Err() while the others still get the result. The ctx given to
+// render is cancelled once every caller is gone, and render should then stop early.
+func (c *Cache) Render(ctx context.Context, key Key, render func(ctx context.Context) ([]byte, error)) ([]byte, Origin, error) {
+	if body, ok := c.Get(key); ok {
+		return body, Hit, nil
+	}
+
+	body, shared, err := c.renders.Do(ctx, key, func(ctx context.Context) ([]byte, error) {
+		// An identical render may have completed since the lookup above.
+		if body, ok := c.Get(key); ok {
+			return body, nil
+		}
+		body, err := render(ctx)
+		if err == nil {
+			c.Put(key, body)
+		}
+		return body, err
+	})
+	if shared {
+		return body, Shared, err
+	}
+	return body, Miss, err
+}
+
+// Put stores body as the result named by key. Results larger than the budget of a
+// tier are not kept in that tier.
+func (c *Cache) Put(key Key, body []byte) {
+	c.mu.Lock()
+	c.memory.add(key, body)
+	c.mu.Unlock()
+
+	if c.disk != nil {
+		c.disk.put(key, body)
+	}
+}
+
+// lru is a set of results bounded by their total size, evicting the least recently
+// used ones first. It is not safe for concurrent use.
+type lru struct {
+	maxSize int64
+	size    int64
+	order   *list.List // of *lruEntry, most recently used first
+	entries map[Key]*list.Element
+}
+
+type lruEntry struct {
+	key  Key
+	body []byte
+}
+
+func newLRU(maxSize int64) *lru {
+	return &lru{maxSize: maxSize, order: list.New(), entries: make(map[Key]*list.Element)}
+}
+
+// get returns the body stored under key and marks it as the most recently used.
+func (l *lru) get(key Key) ([]byte, bool) {
+	elem, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).body, true
+}
+
+// add stores body under key, evicting the least recently used results to stay
+// within the size budget.
+func (l *lru) add(key Key, body []byte) {
+	size := int64(len(body))
+	if size > l.maxSize {
+		return
+	}
+	if elem, ok := l.entries[key]; ok {
+		l.order.MoveToFront(elem)
+		return
+	}
+
+	l.entries[key] = l.order.PushFront(&lruEntry{key: key, body: body})
+	l.size += size
+	for l.size > l.maxSize {
+		oldest := l.order.Back()
+		entry := l.order.Remove(oldest).(*lruEntry)
+		delete(l.entries, entry.key)
+		l.size -= int64(len(entry.body))
+	}
+}
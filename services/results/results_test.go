@@ -0,0 +1,37 @@
+package results
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestDiskVersion checks that the disk tier keeps its results across restarts of the same
+// version, and drops them when opened by another version.
+func TestDiskVersion(t *testing.T) {
+	dir := t.TempDir()
+	key := NewKey([]byte("source"), "negative")
+	open := func(version string) *Cache {
+		t.Helper()
+		c, err := New(Options{DiskDir: dir, DiskSize: 1 << 20, Version: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	open("v1").Put(key, []byte("rendered by v1"))
+	if body, ok := open("v1").Get(key); !ok || string(body) != "rendered by v1" {
+		t.Fatalf("same version: got %q, %v, want the stored result", body, ok)
+	}
+
+	if _, ok := open("v2").Get(key); ok {
+		t.Fatal("another version got the result of v1")
+	}
+	if _, err := os.Stat(filepath.Join(dir, key.String())); !os.IsNotExist(err) {
+		t.Fatalf("the result of v1 is still on disk: %v", err)
+	}
+	if _, ok := open("v1").Get(key); ok {
+		t.Fatal("the result of v1 came back")
+	}
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"context"
+	"image"
+	"image/draw"
+
+	"neko-love/filters"
+)
+
+// Downscale returns img scaled down to size, each destination pixel being the average of
+// the source pixels it covers, which keeps thin details and avoids the aliasing of
+// nearest-neighbour sampling. size must not be larger than img. The result comes from
+// the filter buffer pool; img is left untouched and still belongs to the caller.
+// Scaling stops early with ctx.Err() once ctx is done.
+func Downscale(ctx context.Context, img image.Image, size image.Point) (*image.RGBA, error) {
+	bounds := img.Bounds()
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = filters.NewRGBA(bounds)
+		draw.Draw(src, bounds, img, bounds.Min, draw.Src)
+		defer filters.ReleaseRGBA(src)
+	}
+
+	dst := filters.NewRGBA(image.Rectangle{Max: size})
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	// xStarts[x] is the first source column covered by destination column x, and
+	// xStarts[x+1] the end of its span.
+	xStarts := make([]int, size.X+1)
+	for x := range xStarts {
+		xStarts[x] = x * srcW / size.X
+	}
+
+	err := parallelFor(ctx, size.Y, 0, func(y int) error {
+		y0, y1 := y*srcH/size.Y, (y+1)*srcH/size.Y
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+4*size.X]
+		for x := 0; x < size.X; x++ {
+			x0, x1 := xStarts[x], xStarts[x+1]
+			var r, g, b, a uint64
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(bounds.Min.X+x0, bounds.Min.Y+sy)
+				for s := src.Pix[i : i+4*(x1-x0)]; len(s) >= 4; s = s[4:] {
+					r += uint64(s[0])
+					g += uint64(s[1])
+					b += uint64(s[2])
+					a += uint64(s[3])
+				}
+			}
+			n := uint64((x1 - x0) * (y1 - y0))
+			row[4*x+0] = uint8((r + n/2) / n)
+			row[4*x+1] = uint8((g + n/2) / n)
+			row[4*x+2] = uint8((b + n/2) / n)
+			row[4*x+3] = uint8((a + n/2) / n)
+		}
+		return nil
+	})
+	if err != nil {
+		filters.ReleaseRGBA(dst)
+		return nil, err
+	}
+	return dst, nil
+}
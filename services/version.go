@@ -0,0 +1,70 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RenderVersion returns an identifier of the code rendering images: the Go toolchain,
+// whose encoders are part of the output, and the VCS revision the server was built
+// from. Builds without a clean revision, such as those of modified or exported sources,
+// are identified by the hash of their executable instead. Results rendered by different
+// versions may differ, so the version is part of their cache keys and entity tags.
+var RenderVersion = sync.OnceValue(func() string {
+	version := runtime.Version()
+	if revision, ok := vcsRevision(); ok {
+		return version + "+" + revision
+	}
+	if sum, err := executableHash(); err == nil {
+		return version + "+exe:" + sum
+	}
+	// Without any way to tell builds apart, results are not shared across restarts.
+	return version + "+start:" + strconv.FormatInt(time.Now().UnixNano(), 36)
+})
+
+// vcsRevision returns the revision recorded by the Go toolchain in the executable, unless
+// it was built from sources with uncommitted changes.
+func vcsRevision() (string, bool) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", false
+	}
+	var revision string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			if setting.Value == "true" {
+				return "", false
+			}
+		}
+	}
+	return revision, revision != ""
+}
+
+// executableHash returns the SHA-256 of the running executable.
+func executableHash() (string, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
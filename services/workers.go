@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// parallelFor calls fn for every index in [0, n) using at most workers goroutines,
+// and returns once every call has returned. Zero or negative workers uses one worker
+// per available CPU. Each index is handled at most once, so results written by index
+// keep a deterministic order whatever the scheduling.
+//
+// No new index is handed out once ctx is done or a call has failed: parallelFor then
+// returns the first error of fn, or ctx.Err(), and the skipped indexes are never seen.
+func parallelFor(ctx context.Context, n, workers int, fn func(i int) error) error {
+	return parallelEach(ctx, n, workers,
+		func(i int) int { return i },
+		func(i, _ int) error { return fn(i) },
+		func(int) {})
+}
+
+// parallelEach is like parallelFor, except that the work of every index starts with a
+// value produced by next, which is called in index order on the calling goroutine while
+// fn consumes the values produced before on the workers. It suits work whose first step
+// must be sequential: only the values being consumed, and the one waiting for a worker,
+// exist at once. ctx is checked before every call to next, and a value produced but not
+// handed to fn, because ctx is done or a call failed meanwhile, is given to drop.
+func parallelEach[T any](ctx context.Context, n, workers int, next func(i int) T, fn func(i int, v T) error, drop func(v T)) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(i, next(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		once     sync.Once
+		firstErr error
+	)
+	failed := make(chan struct{})
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(failed)
+		})
+	}
+
+	type item struct {
+		i int
+		v T
+	}
+	items := make(chan item)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range items {
+				if err := fn(it.i, it.v); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for i := 0; i < n; i++ {
+		select {
+		case <-failed:
+			break dispatch
+		case <-ctx.Done():
+			fail(ctx.Err())
+			break dispatch
+		default:
+		}
+
+		v := next(i)
+		select {
+		case items <- item{i, v}:
+		case <-failed:
+			drop(v)
+			break dispatch
+		case <-ctx.Done():
+			drop(v)
+			fail(ctx.Err())
+			break dispatch
+		}
+	}
+	close(items)
+	wg.Wait()
+	return firstErr
+}